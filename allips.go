@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxAllIPs bounds the addresses ?all-ips= dials; any further ones a host
+// resolves to are left unchecked.
+const maxAllIPs = 16
+
+// ipResult is how one address of the host fared with ?all-ips=.
+type ipResult struct {
+	IP        string  `json:"ip"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	Code      string  `json:"code,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+}
+
+// checkAllIPs resolves host and dials port on each of its addresses, up to
+// maxAllIPs of them, at once. The check is OK when any address connects, or
+// with require set to all when every one does; when only some do it fails
+// with PARTIAL_OUTAGE, and when none do with the status of the first.
+func checkAllIPs(ctx context.Context, checker plainTest, host, port, require string) (int, result) {
+	ips, err := checker.Resolve(ctx, host)
+	if err != nil {
+		code, status := http.StatusBadGateway, checker.phaseStatus(err)
+		if status == "DNS_TIMEOUT" {
+			code = http.StatusGatewayTimeout
+		}
+		return code, result{
+			Status: status,
+			Error:  err.Error(),
+			Code:   errorCode(err),
+		}
+	}
+	res := result{ResolvedIPs: ips}
+	if len(ips) > maxAllIPs {
+		res.Note = fmt.Sprintf("checked the first %d of %d addresses", maxAllIPs, len(ips))
+		ips = ips[:maxAllIPs]
+	}
+
+	res.IPs = make([]ipResult, len(ips))
+	codes := make([]int, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, r := checkTCP(ctx, checker, ip, port)
+			codes[i] = code
+			res.IPs[i] = ipResult{
+				IP:        ip,
+				Status:    r.Status,
+				Error:     r.Error,
+				Code:      r.Code,
+				LatencyMS: r.LatencyMS,
+			}
+		}()
+	}
+	wg.Wait()
+
+	ok, first := 0, -1
+	for i, r := range res.IPs {
+		if r.Status == "OK" {
+			ok++
+		} else if first < 0 {
+			first = i
+		}
+	}
+	switch {
+	case ok == len(ips) || (ok > 0 && require != "all"):
+		res.Status = "OK"
+		return http.StatusOK, res
+	case ok > 0:
+		res.Status = "PARTIAL_OUTAGE"
+		res.Error = fmt.Sprintf("%d of %d addresses could not be reached", len(ips)-ok, len(ips))
+		return http.StatusBadGateway, res
+	}
+	res.Status, res.Error, res.Code = res.IPs[first].Status, res.IPs[first].Error, res.IPs[first].Code
+	return codes[first], res
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestAllIPs(t *testing.T) {
+	// 127.0.0.2 is loopback too, but refuses a listener bound to 127.0.0.1
+	resolver, stop := fakeDNSWith(t, 127, 0, 0, 1, 127, 0, 0, 2)
+	defer stop()
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("any", func(t *testing.T) {
+		obj := e.GET("/cdn.invalid:"+port).
+			WithQuery("resolver", resolver).
+			WithQuery("all-ips", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
+		ips := obj.Value("ips").Array()
+		ips.Length().Equal(2)
+		ips.Element(0).Object().ContainsMap(map[string]interface{}{"ip": "127.0.0.1", "status": "OK"})
+		ips.Element(1).Object().ContainsMap(map[string]interface{}{"ip": "127.0.0.2", "status": "HOST_REFUSED"})
+	})
+
+	t.Run("all", func(t *testing.T) {
+		e.GET("/cdn.invalid:"+port).
+			WithQuery("resolver", resolver).
+			WithQuery("all-ips", "true").
+			WithQuery("require", "all").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "PARTIAL_OUTAGE").
+			ContainsKey("ips")
+	})
+
+	t.Run("none", func(t *testing.T) {
+		e.GET("/cdn.invalid:1").
+			WithQuery("resolver", resolver).
+			WithQuery("all-ips", "true").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "HOST_REFUSED")
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		e.GET("/cdn.invalid:"+port).
+			WithQuery("resolver", resolver).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			NotContainsKey("ips")
+	})
+
+	for _, q := range []map[string]string{
+		{"require": "all"},
+		{"all-ips": "true", "require": "most"},
+		{"all-ips": "true", "mode": "tls"},
+		{"all-ips": "true", "proxy": "127.0.0.1:3128"},
+		{"all-ips": "true", "send": "00"},
+	} {
+		req := e.GET("/cdn.invalid:" + port)
+		for k, v := range q {
+			req = req.WithQuery(k, v)
+		}
+		req.Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_ALL_IPS")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// screen reports why host, or proxy (each proxy of a comma separated list),
+// may not be checked, as a result status and an error describing the problem.
+// Host names are resolved, within timeout, when private addresses are denied.
+func (cfg config) screen(host, proxy string, timeout time.Duration) (string, error) {
+	if !cfg.allow.allows(host) {
+		return "TARGET_NOT_ALLOWED", fmt.Errorf("target %q is not on the allowlist", host)
+	}
+	if !cfg.denyPrivate {
+		return "", nil
+	}
+	if err := denyPrivate(host, timeout); err != nil {
+		return "TARGET_DENIED", err
+	}
+	for _, proxy := range splitProxies(proxy) {
+		u, err := parseProxy(proxy)
+		if err != nil {
+			// left for the proxy check to report
+			continue
+		}
+		if err := denyPrivate(u.Hostname(), timeout); err != nil {
+			return "TARGET_DENIED", fmt.Errorf("proxy: %v", err)
+		}
+	}
+	return "", nil
+}
+
+// denyPrivate resolves host and fails if any of its addresses is private,
+// loopback, link-local or unspecified.
+func denyPrivate(host string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %q to check it is public: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !public(addr.IP) {
+			return fmt.Errorf("%q resolves to non-public address %s", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// public reports whether ip is neither private, loopback, link-local nor
+// unspecified.
+func public(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
+
+// notPublicError is the error of a dial publicOnly refused.
+type notPublicError struct {
+	ip net.IP
+}
+
+func (e *notPublicError) Error() string {
+	return fmt.Sprintf("refused to connect to non-public address %s", e.ip)
+}
+
+// publicOnly is a net.Dialer Control hook refusing connections to non-public
+// addresses. screen resolves a host name apart from the dial, so it is the
+// address actually dialed that this checks, and a name answering with a
+// public address first and a private one when dialed is still refused.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host, _, _ = strings.Cut(host, "%")
+	if ip := net.ParseIP(host); ip != nil && !public(ip) {
+		return &notPublicError{ip}
+	}
+	return nil
+}
+
+// deniedAtDial reports a check whose dial publicOnly refused as TARGET_DENIED,
+// whatever status its mode gave it.
+func deniedAtDial(code int, res result) (int, result) {
+	var notPublic *notPublicError
+	if !errors.As(res.err, &notPublic) {
+		return code, res
+	}
+	res.Status = "TARGET_DENIED"
+	res.Error = notPublic.Error()
+	return http.StatusForbidden, res
+}
+
+// allowlist restricts which targets may be checked. Entries are CIDR blocks,
+// bare IP addresses, or host names; a host name also allows its subdomains.
+// A nil allowlist allows every target.
+type allowlist struct {
+	nets  []*net.IPNet
+	names []string
+}
+
+func parseAllowlist(entries []string) (*allowlist, error) {
+	a := &allowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			a.nets = append(a.nets, n)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			name := strings.ToLower(strings.Trim(entry, "."))
+			if strings.ContainsAny(name, " :") {
+				return nil, fmt.Errorf("invalid allowlist entry %q", entry)
+			}
+			a.names = append(a.names, name)
+		}
+	}
+	return a, nil
+}
+
+// allows reports whether host may be checked.
+func (a *allowlist) allows(host string) bool {
+	if a == nil {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range a.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, name := range a.names {
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// listFlag is a flag.Value collecting repeated or comma-separated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
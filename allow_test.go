@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestAllowlist(t *testing.T) {
+	a, err := parseAllowlist([]string{"10.0.0.0/8", "192.168.1.5", "example.com", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"10.1.2.3":         true,
+		"11.1.2.3":         false,
+		"192.168.1.5":      true,
+		"192.168.1.6":      false,
+		"example.com":      true,
+		"api.example.com":  true,
+		"API.Example.com.": true,
+		"badexample.com":   false,
+		"example.com.evil": false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+	} {
+		if actual := a.allows(host); expected != actual {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, host, expected, actual)
+			t.Fail()
+		}
+	}
+
+	if _, err := parseAllowlist([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+	if !(*allowlist)(nil).allows("anything") {
+		t.Error("expected a nil allowlist to allow every target")
+	}
+}
+
+func TestAllowlistServer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+
+	svr := httptest.NewServer(Run(time.Second, WithAllowlist([]string{"127.0.0.0/8"})))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("allowed target", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
+	})
+
+	t.Run("target not allowed", func(t *testing.T) {
+		e.GET("/10.0.0.1:80").
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "TARGET_NOT_ALLOWED")
+	})
+
+	t.Run("target not allowed through proxy", func(t *testing.T) {
+		e.GET("/example.com:80").
+			WithQuery("proxy", ts.Listener.Addr().String()).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "TARGET_NOT_ALLOWED")
+	})
+
+	t.Run("resolver with an allowlist", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("resolver", "127.0.0.1:53").
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "TARGET_DENIED")
+	})
+
+	t.Run("batch target not allowed", func(t *testing.T) {
+		e.POST("/batch").
+			WithJSON(map[string]interface{}{
+				"targets": []map[string]string{{"host": "10.0.0.1", "port": "80"}},
+			}).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Array().
+			Element(0).Object().
+			ValueEqual("status", "TARGET_NOT_ALLOWED")
+	})
+}
+
+func TestDenyPrivate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+
+	svr := httptest.NewServer(Run(time.Second, WithDenyPrivate(true)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	for _, target := range []string{
+		ts.Listener.Addr().String(),
+		"10.1.2.3:80",
+		"192.168.0.1:80",
+		"169.254.169.254:80",
+		"[fd00::1]:80",
+		"0.0.0.0:80",
+		"localhost:80",
+	} {
+		t.Run(target, func(t *testing.T) {
+			e.GET("/"+target).
+				Expect().
+				Status(http.StatusForbidden).
+				JSON().Object().
+				ValueEqual("status", "TARGET_DENIED")
+		})
+	}
+
+	t.Run("private proxy", func(t *testing.T) {
+		e.GET("/8.8.8.8:53").
+			WithQuery("proxy", ts.Listener.Addr().String()).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "TARGET_DENIED")
+	})
+
+	t.Run("resolver", func(t *testing.T) {
+		e.GET("/192.0.2.1:80").
+			WithQuery("resolver", "8.8.8.8:53").
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "TARGET_DENIED")
+	})
+
+	t.Run("public target", func(t *testing.T) {
+		e.GET("/192.0.2.1:80").
+			WithQuery("timeout", "10ms").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			Value("status").String().NotEqual("TARGET_DENIED")
+	})
+}
+
+func TestPublicOnly(t *testing.T) {
+	for address, public := range map[string]bool{
+		"192.0.2.1:80":     true,
+		"[2001:db8::1]:80": true,
+		"127.0.0.1:80":     false,
+		"10.1.2.3:80":      false,
+		"[fe80::1%lo]:80":  false,
+		"169.254.169.254":  false,
+	} {
+		err := publicOnly("tcp", address, nil)
+		if actual := err == nil; public != actual {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, address, public, actual)
+			t.Fail()
+		}
+	}
+
+	// a name screened as public that resolves to a private address by the
+	// time it is dialed is refused at the dial
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	cfg := newConfig([]Option{WithDenyPrivate(true)})
+	code, res := deniedAtDial(checkTCP(context.Background(), plainTest{Dialer: cfg.dialer(time.Second)}, "127.0.0.1", port))
+	if code != http.StatusForbidden || res.Status != "TARGET_DENIED" {
+		t.Errorf("expected 403 TARGET_DENIED, got %d %s: %s", code, res.Status, res.Error)
+	}
+	code, res = deniedAtDial(cfg.proxy(time.Second).check(context.Background(), l.Addr().String(), "192.0.2.1", "80"))
+	if code != http.StatusForbidden || res.Status != "TARGET_DENIED" {
+		t.Errorf("expected 403 TARGET_DENIED for the proxy, got %d %s: %s", code, res.Status, res.Error)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireToken wraps h so that requests must carry token as a bearer token in
+// the Authorization header. An empty token disables the check.
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="willitgo"`)
+			writeJSON(w, http.StatusUnauthorized, result{
+				Status: "UNAUTHORIZED",
+				Error:  "missing or invalid bearer token",
+			})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestToken(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second, WithToken("s3cret")))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("missing token", func(t *testing.T) {
+		res := e.GET("/xyz").Expect().Status(http.StatusUnauthorized)
+		res.Header("WWW-Authenticate").Contains("Bearer")
+		res.JSON().Object().ValueEqual("status", "UNAUTHORIZED")
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		e.POST("/batch").
+			WithHeader("Authorization", "Bearer guess").
+			Expect().
+			Status(http.StatusUnauthorized).
+			JSON().Object().
+			ValueEqual("status", "UNAUTHORIZED")
+	})
+
+	t.Run("valid token", func(t *testing.T) {
+		e.GET("/xyz").
+			WithHeader("Authorization", "Bearer s3cret").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_HOST")
+	})
+
+	t.Run("health and metrics stay open", func(t *testing.T) {
+		e.GET("/healthz").Expect().Status(http.StatusOK)
+		e.GET("/metrics").Expect().Status(http.StatusOK)
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// batchHandler serves POST /batch, checking every target in the request body
+// and answering with their results in the same order. Each check gets the
+// request timeout of its own, and the batch as a whole the ?deadline=, which
+// defaults to, and is capped at, the maximum timeout. Targets not done by the
+// deadline are answered with PENDING or TIMED_OUT placeholders and the
+// response status is 207 rather than 200. A batch of more than
+// cfg.maxBatchTargets targets is refused before any check starts. A
+// text/plain body lists the targets a line at a time, as textTargets reads
+// them.
+func batchHandler(timeout time.Duration, cfg config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, result{
+				Status: "METHOD_NOT_ALLOWED",
+				Error:  r.Method + " not allowed; use POST",
+			})
+			return
+		}
+		timeout, err := requestTimeout(r, timeout, cfg.maxTimeout)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "INVALID_TIMEOUT",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+			})
+			return
+		}
+		deadline, err := requestDuration(r, "deadline", cfg.maxTimeout, cfg.maxTimeout)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "INVALID_DEADLINE",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+			})
+			return
+		}
+		targets, err := batchTargets(w, r, cfg)
+		if err != nil {
+			writeBatchError(w, err)
+			return
+		}
+		ctx := r.Context()
+		if deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, deadline)
+			defer cancel()
+		}
+		results, partial := runBatch(ctx, cfg, targets, timeout)
+		code := http.StatusOK
+		if partial {
+			code = http.StatusMultiStatus
+		}
+		writeJSON(w, code, results)
+	})
+}
+
+// maxTargetBytes is how much of a /batch or /stream body each target it may
+// list is allowed, bounding the body at cfg.maxBatchTargets of them.
+const maxTargetBytes = 16 << 10
+
+// tooManyTargetsError is the error of a batch listing more targets than the
+// max that are checked in one request.
+type tooManyTargetsError struct {
+	max int
+}
+
+func (e *tooManyTargetsError) Error() string {
+	return fmt.Sprintf("more than %d targets listed; at most %d are checked in one request", e.max, e.max)
+}
+
+// batchTargets reads the targets of a /batch request from its body, in JSON
+// or, with a text/plain body, as textTargets reads them. Reading stops as
+// soon as the body lists more than cfg.maxBatchTargets targets or runs past
+// what that many may take, so an oversized batch is never read in full.
+func batchTargets(w http.ResponseWriter, r *http.Request, cfg config) ([]target, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.maxBatchTargets)*maxTargetBytes)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "text/plain" {
+		return textTargets(r, cfg.maxBatchTargets)
+	}
+	return jsonTargets(r.Body, cfg.maxBatchTargets)
+}
+
+// jsonTargets decodes the targets of a JSON batch body, {"targets": [...]},
+// one at a time, failing with a tooManyTargetsError once it comes to the
+// target after the first max.
+func jsonTargets(body io.Reader, max int) ([]target, error) {
+	dec := json.NewDecoder(body)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var targets []target
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key, _ := tok.(string); !strings.EqualFold(key, "targets") {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if tok, err = dec.Token(); err != nil {
+			return nil, err
+		} else if tok == nil {
+			targets = nil
+			continue
+		} else if tok != json.Delim('[') {
+			return nil, fmt.Errorf("targets: want an array, got %v", tok)
+		}
+		targets = targets[:0]
+		for dec.More() {
+			if len(targets) == max {
+				return nil, &tooManyTargetsError{max}
+			}
+			var t target
+			if err := dec.Decode(&t); err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// expectDelim reads the next token of dec, failing unless it is delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("want %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+// writeBatchError answers a batch whose targets could not be read: 413
+// TOO_MANY_TARGETS or BATCH_TOO_LARGE when it is longer than a batch may be,
+// and 400 INVALID_BATCH otherwise.
+func writeBatchError(w http.ResponseWriter, err error) {
+	var tooMany *tooManyTargetsError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooMany):
+		writeJSON(w, http.StatusRequestEntityTooLarge, result{
+			Status: "TOO_MANY_TARGETS",
+			Error:  err.Error(),
+		})
+	case errors.As(err, &tooLarge):
+		writeJSON(w, http.StatusRequestEntityTooLarge, result{
+			Status: "BATCH_TOO_LARGE",
+			Error:  fmt.Sprintf("the body is larger than the %d bytes a batch may take", tooLarge.Limit),
+		})
+	default:
+		writeJSON(w, http.StatusBadRequest, result{
+			Status: "INVALID_BATCH",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+		})
+	}
+}
+
+// textTargets reads the targets of a text/plain /batch request: a host:port
+// on each line, optionally followed by the proxy to check it through. Blank
+// lines and those starting with # are skipped. Each target takes its other
+// options from the query string. Reading stops with a tooManyTargetsError at
+// the target after the first max.
+func textTargets(r *http.Request, max int) ([]target, error) {
+	var targets []target
+	sc := bufio.NewScanner(r.Body)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(targets) == max {
+			return nil, &tooManyTargetsError{max}
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: want host:port and an optional proxy, got %q", n, line)
+		}
+		host, port, err := parseTarget(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		t := queryTarget(r)
+		t.Host, t.Port = host, port
+		if len(fields) == 2 {
+			t.Proxy = fields[1]
+		}
+		targets = append(targets, t)
+	}
+	return targets, sc.Err()
+}
+
+// runBatch checks targets using at most cfg.batchWorkers concurrent checks
+// and returns their results in the same order. partial is set when ctx ended
+// before every check finished, in which case the rest hold placeholders.
+func runBatch(ctx context.Context, cfg config, targets []target, timeout time.Duration) (results []result, partial bool) {
+	results = make([]result, len(targets))
+	partial = streamBatch(ctx, cfg, targets, timeout, func(i int, res result) {
+		results[i] = res
+	})
+	return results, partial
+}
+
+// streamBatch checks targets using at most cfg.batchWorkers concurrent checks,
+// calling emit with the index and result of each target as soon as its check
+// finishes. emit is called from one goroutine at a time. Each check is traced
+// as a child of the span in ctx, if any.
+//
+// Once ctx ends no more checks are started, and streamBatch returns without
+// waiting for those still running: every target without a result is emitted
+// as PENDING, if its check never started, or TIMED_OUT, and partial is set.
+func streamBatch(ctx context.Context, cfg config, targets []target, timeout time.Duration, emit func(int, result)) (partial bool) {
+	type finished struct {
+		i   int
+		res result
+	}
+	jobs := make(chan int)
+	// buffered so checks still running after streamBatch returns can finish
+	done := make(chan finished, len(targets))
+	started := make([]int32, len(targets))
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.batchWorkers && i < len(targets); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				atomic.StoreInt32(&started[j], 1)
+				cfg.metrics.inFlight.Inc()
+				sctx, s := startSpan(ctx, "check", trace.SpanKindInternal)
+				s.SetAttributes(attribute.String("host", targets[j].Host), attribute.String("port", targets[j].Port))
+				if targets[j].Proxy != "" {
+					s.SetAttributes(attribute.String("proxy", targets[j].Proxy))
+				}
+				start := time.Now()
+				_, res := checkTarget(sctx, cfg, timeout, targets[j])
+				cfg.metrics.observe(res.Status, time.Since(start))
+				s.SetAttributes(attribute.String("status", res.Status))
+				setSpanStatus(s, res.Error == "", res.Error)
+				s.End()
+				cfg.metrics.inFlight.Dec()
+				done <- finished{j, res}
+			}
+		}()
+	}
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(done)
+		}()
+		for i := range targets {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	emitted := make([]bool, len(targets))
+	for {
+		select {
+		case f, ok := <-done:
+			if !ok {
+				return false
+			}
+			emitted[f.i] = true
+			emit(f.i, f.res)
+		case <-ctx.Done():
+			for i := range targets {
+				if emitted[i] {
+					continue
+				}
+				res := result{Status: "PENDING", Target: targets[i].String(), Error: "the batch ended before the check started: " + ctx.Err().Error()}
+				if atomic.LoadInt32(&started[i]) == 1 {
+					res = result{Status: "TIMED_OUT", Target: targets[i].String(), Error: "the batch ended before the check finished: " + ctx.Err().Error()}
+				}
+				emit(i, res)
+			}
+			return true
+		}
+	}
+}
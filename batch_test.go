@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestBatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	svr := httptest.NewServer(Run(time.Second, WithBatchWorkers(2)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("results in order", func(t *testing.T) {
+		results := e.POST("/batch").
+			WithJSON(map[string]interface{}{
+				"targets": []map[string]string{
+					{"host": host, "port": port},
+					{"host": "127.0.0.1", "port": "1"},
+					{"host": host, "port": port, "proxy": "abc"},
+				},
+			}).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Array()
+		results.Length().Equal(3)
+		results.Element(0).Object().ValueEqual("status", "OK").
+			ValueEqual("target", ts.Listener.Addr().String())
+		results.Element(1).Object().ValueEqual("status", "HOST_REFUSED").
+			ValueEqual("target", "127.0.0.1:1")
+		results.Element(2).Object().ContainsMap(map[string]interface{}{
+			"status": "INVALID_PROXY",
+			"proxy":  "abc",
+			"target": ts.Listener.Addr().String(),
+		})
+	})
+
+	t.Run("invalid hosts", func(t *testing.T) {
+		results := e.POST("/batch").
+			WithJSON(map[string]interface{}{
+				"targets": []map[string]string{
+					{"host": "", "port": "80"},
+					{"host": "127.0.0.1", "port": "99999"},
+					{"host": "127.0.0.1\n", "port": "80"},
+					{"host": host, "port": port},
+				},
+			}).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Array()
+		results.Length().Equal(4)
+		for i := 0; i < 3; i++ {
+			results.Element(i).Object().ValueEqual("status", "INVALID_HOST")
+		}
+		results.Element(3).Object().ValueEqual("status", "OK")
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		e.POST("/batch").
+			WithText("targets").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_BATCH")
+	})
+
+	t.Run("text body", func(t *testing.T) {
+		results := e.POST("/batch").
+			WithQuery("mode", "tcp").
+			WithText("# targets to check\n" +
+				ts.Listener.Addr().String() + "\n" +
+				"\n" +
+				"  127.0.0.1:1  \n" +
+				ts.Listener.Addr().String() + " abc\n").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Array()
+		results.Length().Equal(3)
+		results.Element(0).Object().ValueEqual("status", "OK")
+		results.Element(1).Object().ValueEqual("status", "HOST_REFUSED")
+		results.Element(2).Object().ValueEqual("status", "INVALID_PROXY").
+			ValueEqual("proxy", "abc")
+	})
+
+	for _, body := range []string{"127.0.0.1\n", "127.0.0.1:80 abc extra\n"} {
+		t.Run("invalid text body "+body, func(t *testing.T) {
+			e.POST("/batch").
+				WithText(body).
+				Expect().
+				Status(http.StatusBadRequest).
+				JSON().Object().
+				ValueEqual("status", "INVALID_BATCH").
+				Value("error").String().Contains("line 1")
+		})
+	}
+
+	t.Run("requires POST", func(t *testing.T) {
+		e.GET("/batch").
+			Expect().
+			Status(http.StatusMethodNotAllowed).
+			JSON().Object().
+			ValueEqual("status", "METHOD_NOT_ALLOWED")
+	})
+}
+
+func TestBatchDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	// accepts connections but never answers a request
+	slow, _ := net.Listen("tcp", "127.0.0.1:")
+	defer slow.Close()
+	go func() {
+		for {
+			c, err := slow.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	slowHost, slowPort, _ := net.SplitHostPort(slow.Addr().String())
+
+	svr := httptest.NewServer(Run(5*time.Second, WithBatchWorkers(1)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	start := time.Now()
+	results := e.POST("/batch").
+		WithQuery("deadline", "300ms").
+		WithJSON(map[string]interface{}{
+			"targets": []map[string]string{
+				{"host": host, "port": port},
+				{"host": slowHost, "port": slowPort, "mode": "http"},
+				{"host": host, "port": port},
+			},
+		}).
+		Expect().
+		Status(http.StatusMultiStatus).
+		JSON().Array()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("batch took %v, past its deadline", elapsed)
+	}
+	results.Length().Equal(3)
+	results.Element(0).Object().ValueEqual("status", "OK")
+	results.Element(1).Object().ValueEqual("status", "TIMED_OUT").
+		ValueEqual("target", slow.Addr().String())
+	results.Element(2).Object().ValueEqual("status", "PENDING").
+		ValueEqual("target", ts.Listener.Addr().String())
+
+	e.POST("/batch").
+		WithQuery("deadline", "soon").
+		WithJSON(map[string]interface{}{"targets": []map[string]string{}}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_DEADLINE")
+}
+
+func TestBatchTooManyTargets(t *testing.T) {
+	// counts the connections the checks open
+	var dialed int32
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dialed, 1)
+			c.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	svr := httptest.NewServer(Run(time.Second, WithMaxBatchTargets(2)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	target := map[string]string{"host": host, "port": port}
+	e.POST("/batch").
+		WithJSON(map[string]interface{}{
+			"targets": []map[string]string{target, target, target},
+		}).
+		Expect().
+		Status(http.StatusRequestEntityTooLarge).
+		JSON().Object().
+		ValueEqual("status", "TOO_MANY_TARGETS")
+	e.POST("/batch").
+		WithText(strings.Repeat(l.Addr().String()+"\n", 3)).
+		Expect().
+		Status(http.StatusRequestEntityTooLarge).
+		JSON().Object().
+		ValueEqual("status", "TOO_MANY_TARGETS")
+	e.POST("/stream").
+		WithJSON(map[string]interface{}{
+			"targets": []map[string]string{target, target, target},
+		}).
+		Expect().
+		Status(http.StatusRequestEntityTooLarge).
+		JSON().Object().
+		ValueEqual("status", "TOO_MANY_TARGETS")
+
+	// the body is read no further than the target past the limit, so what
+	// follows it is never seen
+	t3 := fmt.Sprintf(`{"host":%q,"port":%q}`, host, port)
+	e.POST("/batch").
+		WithBytes([]byte(`{"targets":[`+t3+`,`+t3+`,`+t3+`,not json`)).
+		WithHeader("Content-Type", "application/json").
+		Expect().
+		Status(http.StatusRequestEntityTooLarge).
+		JSON().Object().
+		ValueEqual("status", "TOO_MANY_TARGETS")
+	e.POST("/batch").
+		WithText(strings.Repeat("#"+strings.Repeat(" ", 1<<10)+"\n", 2*maxTargetBytes>>10+1)).
+		Expect().
+		Status(http.StatusRequestEntityTooLarge).
+		JSON().Object().
+		ValueEqual("status", "BATCH_TOO_LARGE")
+	if n := atomic.LoadInt32(&dialed); n != 0 {
+		t.Errorf("expected no checks to run, got %d connections", n)
+	}
+
+	// a batch at the limit is checked
+	e.POST("/batch").
+		WithJSON(map[string]interface{}{
+			"targets": []map[string]string{target, target},
+		}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array().
+		Length().Equal(2)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// resultCache makes identical checks that run at the same time share one
+// dial: those made while one is running wait for it and share its outcome,
+// counted in metrics as coalesced. With a positive ttl it also remembers each
+// outcome for ttl, so a monitor polling the same target in quick succession
+// is answered without dialing it again. A nil resultCache does neither.
+type resultCache struct {
+	ttl     time.Duration
+	group   singleflight.Group
+	metrics *metrics
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	swept   time.Time
+}
+
+type cacheEntry struct {
+	code    int
+	res     result
+	expires time.Time
+	// canceled is set when the check was cut short by its caller going
+	// away.
+	canceled bool
+}
+
+// newResultCache returns a cache keeping results for ttl, or only coalescing
+// checks when ttl is not positive.
+func newResultCache(ttl time.Duration, m *metrics) *resultCache {
+	return &resultCache{ttl: ttl, metrics: m, entries: map[string]cacheEntry{}}
+}
+
+// cacheKey identifies the checks that may share a result: the same host,
+// port, proxy and mode, with the same mode options and timeout.
+func cacheKey(t target, timeout time.Duration) string {
+	// every field, where t.String would give only the host and port
+	type fields target
+	return fmt.Sprintf("%+v %v", fields(t), timeout)
+}
+
+// do returns the cached outcome for key, marked Cached, while it is fresh, and
+// otherwise runs check, sharing its outcome with the identical checks that
+// arrive while it runs. Only the caller that ran check gets the outcome
+// unmarked. An outcome cut short by ctx ending is neither kept nor shared:
+// the checks that were waiting on it run check for themselves.
+func (c *resultCache) do(ctx context.Context, key string, check func() (int, result)) (int, result) {
+	if c == nil {
+		return check()
+	}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		e.res.Cached = true
+		return e.code, e.res
+	}
+
+	ran := false
+	v, _, _ := c.group.Do(key, func() (interface{}, error) {
+		ran = true
+		code, res := check()
+		e := cacheEntry{code: code, res: res, expires: time.Now().Add(c.ttl), canceled: ctx.Err() != nil}
+		if c.ttl > 0 && !e.canceled {
+			c.store(key, e)
+		}
+		return e, nil
+	})
+	e = v.(cacheEntry)
+	if !ran && e.canceled {
+		return check()
+	}
+	if !ran {
+		c.metrics.coalesced.Inc()
+		e.res.Cached = true
+	}
+	return e.code, e.res
+}
+
+// store keeps e under key, first dropping the expired entries when they were
+// last swept a ttl or more ago.
+func (c *resultCache) store(key string, e cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.swept) >= c.ttl {
+		for k, old := range c.entries {
+			if now.After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[key] = e
+}
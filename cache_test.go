@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCache(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	var accepted int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			c.Close()
+		}
+	}()
+
+	t.Run("repeated checks are served from the cache", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second, WithCacheTTL(time.Minute)))
+		defer svr.Close()
+		e := httpexpect.New(t, svr.URL)
+
+		e.GET("/"+l.Addr().String()).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			NotContainsKey("cached")
+		e.GET("/"+l.Addr().String()).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("cached", true)
+		// a different mode is a different check
+		e.GET("/"+l.Addr().String()).
+			WithQuery("mode", "scan").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			NotContainsKey("cached")
+		if n := atomic.LoadInt64(&accepted); n != 2 {
+			t.Errorf("target accepted %d connections, want 2", n)
+		}
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second))
+		defer svr.Close()
+		e := httpexpect.New(t, svr.URL)
+
+		for i := 0; i < 2; i++ {
+			e.GET("/" + l.Addr().String()).
+				Expect().
+				Status(http.StatusOK).
+				JSON().Object().
+				NotContainsKey("cached")
+		}
+	})
+}
+
+func TestResultCacheCoalesces(t *testing.T) {
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		testCoalesces(t, ttl)
+	}
+}
+
+func testCoalesces(t *testing.T, ttl time.Duration) {
+	m := newMetrics()
+	c := newResultCache(ttl, m)
+	var calls int64
+	release := make(chan struct{})
+	check := func() (int, result) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return http.StatusOK, result{Status: "OK"}
+	}
+
+	var wg sync.WaitGroup
+	var cached int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, res := c.do(context.Background(), "key", check)
+			if res.Cached {
+				atomic.AddInt64(&cached, 1)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("ttl %v: check ran %d times, want 1", ttl, calls)
+	}
+	if cached != 9 {
+		t.Errorf("ttl %v: %d results were marked cached, want 9", ttl, cached)
+	}
+	if n := testutil.ToFloat64(m.coalesced); ttl == 0 && n != 9 {
+		t.Errorf("ttl %v: %v checks were counted as coalesced, want 9", ttl, n)
+	}
+
+	// only a cache remembers the result once the check is done
+	_, res := c.do(context.Background(), "key", func() (int, result) {
+		return http.StatusOK, result{Status: "OK"}
+	})
+	if res.Cached != (ttl > 0) {
+		t.Errorf("ttl %v: later check cached %v", ttl, res.Cached)
+	}
+}
+
+func TestResultCacheCanceled(t *testing.T) {
+	c := newResultCache(0, newMetrics())
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.do(ctx, "key", func() (int, result) {
+			close(started)
+			<-ctx.Done()
+			return http.StatusBadGateway, result{Status: "HOST_CONNECT_FAIL"}
+		})
+	}()
+	<-started
+
+	var code int
+	var res result
+	waited := make(chan struct{})
+	go func() {
+		defer close(waited)
+		code, res = c.do(context.Background(), "key", func() (int, result) {
+			return http.StatusOK, result{Status: "OK"}
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	<-waited
+
+	// the waiting check did not take the canceled one's outcome
+	if code != http.StatusOK || res.Status != "OK" || res.Cached {
+		t.Errorf("got %d %+v, want an uncached OK", code, res)
+	}
+}
+
+func TestResultCacheExpiry(t *testing.T) {
+	c := newResultCache(time.Millisecond, newMetrics())
+	var calls int
+	check := func() (int, result) {
+		calls++
+		return http.StatusOK, result{Status: "OK"}
+	}
+	c.do(context.Background(), "key", check)
+	time.Sleep(5 * time.Millisecond)
+	if _, res := c.do(context.Background(), "key", check); res.Cached || calls != 2 {
+		t.Errorf("expired result was served: cached %v after %d checks", res.Cached, calls)
+	}
+
+	// a check cut short by its caller is not kept
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = newResultCache(time.Minute, newMetrics())
+	c.do(ctx, "key", check)
+	if _, res := c.do(context.Background(), "key", check); res.Cached || calls != 4 {
+		t.Errorf("canceled result was served: cached %v after %d checks", res.Cached, calls)
+	}
+}
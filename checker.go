@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// Checker checks a target in one mode, returning the HTTP status code and
+// result to report.
+type Checker interface {
+	Check(ctx context.Context, host, port string, opts Options) (int, result)
+}
+
+// Options is what a Checker needs beyond the host and port.
+type Options struct {
+	// Dialer makes the check's connections, with its timeout, source
+	// address, address family, resolver and PROXY protocol header.
+	Dialer plainTest
+	// Target is the check as asked for, carrying the mode's own options
+	// such as Path or Probe.
+	Target target
+
+	cfg config
+}
+
+// checkers holds the Checker of every mode, keyed by the mode's name. A new
+// mode is a type implementing Checker, registered here and described in
+// modes.
+var checkers = map[string]Checker{
+	"tcp":   tcpChecker{},
+	"scan":  scanChecker{},
+	"tls":   tlsChecker{},
+	"http":  httpChecker{},
+	"https": httpChecker{secure: true},
+	"dns":   dnsChecker{},
+	"grpc":  grpcChecker{},
+	"ws":    wsChecker{},
+	"wss":   wsChecker{secure: true},
+	"smtp":  smtpChecker{},
+	"ssh":   sshChecker{},
+	"ping":  pingChecker{},
+}
+
+// tcpChecker opens a connection, over TCP, UDP or a unix socket as the
+// target's proto asks, and closes it again, first exchanging the target's
+// payload when it has one. With AllIPs it does so for every address of the
+// host.
+type tcpChecker struct{}
+
+func (tcpChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	d, t := opts.Dialer, opts.Target
+	if t.Proto == "udp" {
+		d.Network = "udp" + strings.TrimPrefix(d.Network, "tcp")
+		return checkUDP(ctx, d, host, port, t.Probe)
+	}
+	if t.Send != "" || t.Expect != "" {
+		send, _ := decodePayload("send", t.Send)
+		expect, _ := decodePayload("expect", t.Expect)
+		return checkPayload(ctx, d, host, port, send, expect)
+	}
+	d.Retries = t.Retries
+	if t.AllIPs {
+		return checkAllIPs(ctx, d, host, port, t.Require)
+	}
+	code, res := checkTCP(ctx, d, host, port)
+	if t.Retries == 0 {
+		res.Attempts = 0
+	}
+	return code, res
+}
+
+// scanChecker is a tcpChecker that reports how it probed the port.
+type scanChecker struct{}
+
+func (scanChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	code, res := tcpChecker{}.Check(ctx, host, port, opts)
+	// unprivileged processes cannot send a bare SYN, so a scan is the same
+	// full connect, closed at once, and says so
+	res.Method = "full-connect"
+	return code, res
+}
+
+type tlsChecker struct{}
+
+func (tlsChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	var alpn []string
+	if opts.Target.ALPN != "" {
+		alpn = strings.Split(opts.Target.ALPN, ",")
+	}
+	return checkTLS(ctx, opts.cfg, opts.Dialer, host, port, alpn)
+}
+
+type httpChecker struct{ secure bool }
+
+func (c httpChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	return checkHTTP(ctx, opts.cfg, opts.Dialer, host, port, opts.Target.Path, c.secure, opts.Target.Follow)
+}
+
+type dnsChecker struct{}
+
+func (dnsChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	return checkDNS(ctx, opts.Dialer, host, opts.Target.Record)
+}
+
+type grpcChecker struct{}
+
+func (grpcChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	return checkGRPC(ctx, opts.cfg, opts.Dialer, host, port, opts.Target.TLS)
+}
+
+type wsChecker struct{ secure bool }
+
+func (c wsChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	return checkWS(ctx, opts.cfg, opts.Dialer, host, port, opts.Target.Path, c.secure, opts.Target.Probe)
+}
+
+type smtpChecker struct{}
+
+func (smtpChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	return checkSMTP(ctx, opts.Dialer, host, port, opts.Target.Probe)
+}
+
+type sshChecker struct{}
+
+func (sshChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	return checkSSH(ctx, opts.Dialer, host, port)
+}
+
+type pingChecker struct{}
+
+func (pingChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	return checkPing(ctx, opts.Dialer, host)
+}
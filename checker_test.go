@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCheckersRegistered(t *testing.T) {
+	var exp, got []string
+	for _, m := range modes {
+		exp = append(exp, m.Name)
+	}
+	for name := range checkers {
+		got = append(got, name)
+	}
+	sort.Strings(exp)
+	sort.Strings(got)
+	if !reflect.DeepEqual(exp, got) {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, exp, got)
+		t.Fail()
+	}
+}
+
+func TestTCPChecker(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	opts := Options{Dialer: plainTest{Dialer: net.Dialer{Timeout: time.Second}}}
+
+	for _, c := range []struct {
+		checker Checker
+		port    string
+		code    int
+		status  string
+		method  string
+	}{
+		{tcpChecker{}, port, http.StatusOK, "OK", ""},
+		{tcpChecker{}, "1", http.StatusBadGateway, "HOST_REFUSED", ""},
+		{scanChecker{}, port, http.StatusOK, "OK", "full-connect"},
+	} {
+		code, res := c.checker.Check(context.Background(), host, c.port, opts)
+		for _, v := range []struct{ exp, got interface{} }{
+			{c.code, code},
+			{c.status, res.Status},
+			{c.method, res.Method},
+		} {
+			if !reflect.DeepEqual(v.exp, v.got) {
+				_, file, line, _ := runtime.Caller(0)
+				t.Logf("%s:%d: %T port %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.checker, c.port, v.exp, v.got)
+				t.Fail()
+			}
+		}
+	}
+}
+
+// dialerChecker records the dialer it is given.
+type dialerChecker struct{ got *net.Dialer }
+
+func (c dialerChecker) Check(ctx context.Context, host, port string, opts Options) (int, result) {
+	*c.got = opts.Dialer.Dialer
+	return http.StatusOK, result{Status: "OK"}
+}
+
+func TestDialerTuning(t *testing.T) {
+	var got net.Dialer
+	defer func(c Checker) { checkers["tcp"] = c }(checkers["tcp"])
+	checkers["tcp"] = dialerChecker{&got}
+
+	cfg := newConfig([]Option{WithDialKeepAlive(-1), WithFallbackDelay(50 * time.Millisecond)})
+	checkTarget(context.Background(), cfg, 2*time.Second, target{Host: "127.0.0.1", Port: "1"})
+	exp := net.Dialer{Timeout: 2 * time.Second, KeepAlive: -1, FallbackDelay: 50 * time.Millisecond}
+	if !reflect.DeepEqual(exp, got) {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, exp, got)
+		t.Fail()
+	}
+}
+
+func TestConnectAnyFallback(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// the IPv6 address stands for a broken route: its dial hangs until the
+	// test ends, or fails at once
+	hang := make(chan struct{})
+	defer close(hang)
+	for _, c := range []struct {
+		name  string
+		delay time.Duration
+		ipv6  func() error
+	}{
+		{"slow ipv6", 20 * time.Millisecond, func() error { <-hang; return errors.New("gave up") }},
+		{"failed ipv6", time.Hour, func() error { return errors.New("no route") }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			checker := plainTest{Dialer: net.Dialer{
+				Timeout:       5 * time.Second,
+				FallbackDelay: c.delay,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					if strings.HasPrefix(address, "[") {
+						return c.ipv6()
+					}
+					return nil
+				},
+			}}
+			done := make(chan error, 1)
+			go func() {
+				conn, _, err := checker.connectAny(context.Background(), []string{"::1", "127.0.0.1"}, port)
+				if err == nil {
+					if exp, got := l.Addr().String(), conn.RemoteAddr().String(); exp != got {
+						err = fmt.Errorf("connected to %s, want %s", got, exp)
+					}
+					conn.Close()
+				}
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Error(err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Error("the IPv4 address was not raced against the IPv6 one")
+			}
+		})
+	}
+}
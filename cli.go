@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// Exit codes of a one-shot -check run.
+const (
+	exitOK      = 0 // the check passed
+	exitFailed  = 1 // the target, or the proxy, could not be reached
+	exitInvalid = 2 // the check could not be run as asked, e.g. a malformed or disallowed target
+)
+
+// runCheck performs a single check of addr, through proxy when set, the same
+// way the HTTP handler would. It writes the result as JSON to out and returns
+// the exit code for it.
+func runCheck(cfg config, timeout time.Duration, addr, proxy string, out io.Writer) int {
+	var res result
+	host, port, err := parseTarget(addr)
+	if err != nil {
+		res = result{Status: "INVALID_HOST", Target: addr, Error: err.Error(), Code: errorCode(err)}
+	} else {
+		_, res = checkTarget(context.Background(), cfg, timeout, target{Host: host, Port: port, Proxy: proxy})
+	}
+	json.NewEncoder(out).Encode(res)
+	return exitCode(res)
+}
+
+// exitCode maps the status of res to an exit code.
+func exitCode(res result) int {
+	switch {
+	case res.Status == "OK":
+		return exitOK
+	case strings.HasPrefix(res.Status, "INVALID_"), strings.HasPrefix(res.Status, "TARGET_"):
+		return exitInvalid
+	}
+	return exitFailed
+}
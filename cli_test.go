@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRunCheck(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, c := range []struct {
+		name, addr, proxy string
+		opts              []Option
+		code              int
+		status            string
+	}{
+		{"ok", l.Addr().String(), "", nil, exitOK, "OK"},
+		{"refused", "127.0.0.1:1", "", nil, exitFailed, "HOST_REFUSED"},
+		{"proxy unreachable", "example.com:443", "127.0.0.1:1", nil, exitFailed, "PROXY_UNREACHABLE"},
+		{"invalid host", "127.0.0.1", "", nil, exitInvalid, "INVALID_HOST"},
+		{"not allowed", l.Addr().String(), "", []Option{WithAllowlist([]string{"10.0.0.0/8"})}, exitInvalid, "TARGET_NOT_ALLOWED"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			code := runCheck(newConfig(c.opts), time.Second, c.addr, c.proxy, &out)
+			var res result
+			if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+				t.Fatalf("output %q is not JSON: %v", out.String(), err)
+			}
+			if code != c.code || res.Status != c.status {
+				t.Errorf("expected exit %d with %s, got exit %d with %s", c.code, c.status, code, res.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// errorCode classifies err by its type, or the type of an error it wraps,
+// as a stable code for programs to act on, leaving the message in the error
+// field for people. It returns "" for errors it does not recognise.
+func errorCode(err error) string {
+	var addrErr *net.AddrError
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var numErr *strconv.NumError
+	var readErr *readTimeoutError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &addrErr):
+		if strings.Contains(addrErr.Err, "missing port") {
+			return "ERR_MISSING_PORT"
+		}
+		return "ERR_BAD_ADDRESS"
+	case errors.Is(err, errNoA), errors.Is(err, errNoAAAA):
+		return "ERR_NO_ADDRESS"
+	case errors.As(err, &dnsErr):
+		switch {
+		case dnsErr.IsNotFound:
+			return "ERR_DNS_NOT_FOUND"
+		case dnsErr.IsTimeout:
+			return "ERR_DNS_TIMEOUT"
+		}
+		return "ERR_DNS"
+	case errors.Is(err, context.Canceled):
+		return "ERR_CANCELED"
+	case errors.As(err, &readErr):
+		return "ERR_READ_TIMEOUT"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "ERR_TIMEOUT"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "ERR_REFUSED"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "ERR_RESET"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "ERR_UNREACHABLE"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "ERR_ADDR_NOT_AVAILABLE"
+	case errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &authErr), errors.As(err, &invalidErr):
+		return "ERR_TLS_CERT"
+	case errors.As(err, &alertErr), errors.As(err, &recordErr):
+		return "ERR_TLS"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "ERR_EOF"
+	case errors.As(err, &numErr):
+		return "ERR_BAD_NUMBER"
+	}
+	return ""
+}
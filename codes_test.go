@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestErrorCode(t *testing.T) {
+	_, _, missingPort := net.SplitHostPort("abc")
+	_, _, tooManyColons := net.SplitHostPort("a:b:c")
+	_, badNumber := strconv.Atoi("x")
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, c := range []struct {
+		err error
+		exp string
+	}{
+		{nil, ""},
+		{missingPort, "ERR_MISSING_PORT"},
+		{tooManyColons, "ERR_BAD_ADDRESS"},
+		{fmt.Errorf("example.com: %w", errNoAAAA), "ERR_NO_ADDRESS"},
+		{&net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, "ERR_DNS_NOT_FOUND"},
+		{&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, "ERR_DNS_TIMEOUT"},
+		{&net.DNSError{Err: "server misbehaving", Name: "example.com"}, "ERR_DNS"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, "ERR_TIMEOUT"},
+		{context.DeadlineExceeded, "ERR_TIMEOUT"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled}, "ERR_CANCELED"},
+		{dialErr(syscall.ECONNREFUSED), "ERR_REFUSED"},
+		{dialErr(syscall.ECONNRESET), "ERR_RESET"},
+		{dialErr(syscall.EHOSTUNREACH), "ERR_UNREACHABLE"},
+		{dialErr(syscall.EADDRNOTAVAIL), "ERR_ADDR_NOT_AVAILABLE"},
+		{&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, "ERR_TLS_CERT"},
+		{tls.AlertError(40), "ERR_TLS"},
+		{fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), "ERR_EOF"},
+		{badNumber, "ERR_BAD_NUMBER"},
+		{fmt.Errorf("something else"), ""},
+	} {
+		if got := errorCode(c.err); !reflect.DeepEqual(c.exp, got) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %v\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.err, c.exp, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestErrorCodeField(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	e.GET("/abc").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status": "INVALID_HOST",
+			"code":   "ERR_MISSING_PORT",
+		})
+	e.GET("/127.0.0.1:1").
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status": "HOST_REFUSED",
+			"code":   "ERR_REFUSED",
+		})
+}
+
+func TestErrno(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNRESET)}
+	for _, c := range []struct {
+		err error
+		exp int
+	}{
+		{dialErr, int(syscall.ECONNRESET)},
+		{fmt.Errorf("proxy: %w", dialErr), int(syscall.ECONNRESET)},
+		{syscall.ENETUNREACH, int(syscall.ENETUNREACH)},
+		{io.EOF, 0},
+		{nil, 0},
+	} {
+		if got := errno(c.err); c.exp != got {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %v\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.err, c.exp, got)
+			t.Fail()
+		}
+	}
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	for _, c := range []struct {
+		path  string
+		query map[string]string
+	}{
+		{"/127.0.0.1:1", nil},
+		{"/127.0.0.1:1", map[string]string{"mode": "tls"}},
+		{"/127.0.0.1:1", map[string]string{"mode": "http"}},
+		{"/example.com:443", map[string]string{"proxy": "127.0.0.1:1"}},
+	} {
+		req := e.GET(c.path).WithQuery("raw-error", "true")
+		for k, v := range c.query {
+			req = req.WithQuery(k, v)
+		}
+		req.Expect().
+			JSON().Object().
+			ValueEqual("errno", int(syscall.ECONNREFUSED))
+	}
+	e.GET("/127.0.0.1:1").
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		NotContainsKey("errno")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fileConfig holds the settings that can be given in a -config file. Each
+// field sets the flag of the same name, with dashes for underscores, unless
+// that flag was given on the command line.
+type fileConfig struct {
+	Addr          *string  `json:"addr"`
+	Timeout       *string  `json:"timeout"`
+	Allow         []string `json:"allow"`
+	Token         *string  `json:"token"`
+	TLSCert       *string  `json:"tls_cert"`
+	TLSKey        *string  `json:"tls_key"`
+	MaxConcurrent *int     `json:"max_concurrent"`
+}
+
+// loadConfigFile reads a JSON config file, rejecting unknown keys.
+func loadConfigFile(path string) (fileConfig, error) {
+	var fc fileConfig
+	f, err := os.Open(path)
+	if err != nil {
+		return fc, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return fc, fmt.Errorf("config %s: %v", path, err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return fc, fmt.Errorf("config %s: unexpected data after the top-level object", path)
+	}
+	return fc, nil
+}
+
+// apply sets the flags of fs named in fc, leaving those already set on the
+// command line alone so that flags override the file.
+func (fc fileConfig) apply(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	values := map[string]string{}
+	if fc.Addr != nil {
+		values["addr"] = *fc.Addr
+	}
+	if fc.Timeout != nil {
+		values["timeout"] = *fc.Timeout
+	}
+	if fc.Allow != nil {
+		values["allow"] = strings.Join(fc.Allow, ",")
+	}
+	if fc.Token != nil {
+		values["token"] = *fc.Token
+	}
+	if fc.TLSCert != nil {
+		values["tls-cert"] = *fc.TLSCert
+	}
+	if fc.TLSKey != nil {
+		values["tls-key"] = *fc.TLSKey
+	}
+	if fc.MaxConcurrent != nil {
+		values["max-concurrent"] = strconv.Itoa(*fc.MaxConcurrent)
+	}
+	for name, value := range values {
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %v", strings.ReplaceAll(name, "-", "_"), err)
+		}
+	}
+	return nil
+}
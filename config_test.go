@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("willitgo", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "")
+	timeout := fs.Duration("timeout", 5*time.Second, "")
+	token := fs.String("token", "", "")
+	maxConcurrent := fs.Int("max-concurrent", 100, "")
+	var allow listFlag
+	fs.Var(&allow, "allow", "")
+	fs.String("tls-cert", "", "")
+	fs.String("tls-key", "", "")
+	if err := fs.Parse([]string{"-addr", ":9090"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fc, err := loadConfigFile(writeConfig(t, `{
+		"addr": ":7070",
+		"timeout": "2s",
+		"allow": ["10.0.0.0/8", "example.com"],
+		"max_concurrent": 20
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fc.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ exp, got interface{} }{
+		{":9090", *addr},
+		{2 * time.Second, *timeout},
+		{"", *token},
+		{20, *maxConcurrent},
+		{listFlag{"10.0.0.0/8", "example.com"}, allow},
+	} {
+		if !reflect.DeepEqual(c.exp, c.got) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.exp, c.got)
+			t.Fail()
+		}
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, content, exp string
+	}{
+		{"unknown key", `{"adress": ":80"}`, `unknown field "adress"`},
+		{"malformed", `{"addr": ":80"`, "unexpected EOF"},
+		{"wrong type", `{"max_concurrent": "many"}`, "max_concurrent"},
+		{"trailing data", `{} {}`, "unexpected data"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := loadConfigFile(writeConfig(t, c.content))
+			if err == nil || !strings.Contains(err.Error(), c.exp) {
+				t.Errorf("expected an error containing %q, got %v", c.exp, err)
+			}
+		})
+	}
+
+	t.Run("bad value", func(t *testing.T) {
+		fs := flag.NewFlagSet("willitgo", flag.ContinueOnError)
+		fs.Duration("timeout", 5*time.Second, "")
+		fc, err := loadConfigFile(writeConfig(t, `{"timeout": "soon"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fc.apply(fs); err == nil || !strings.HasPrefix(err.Error(), "timeout:") {
+			t.Errorf("expected a timeout error, got %v", err)
+		}
+	})
+}
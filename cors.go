@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsMethods and corsHeaders are the methods and request headers browsers
+// may use cross-origin, and corsExposed the response headers their scripts
+// may read.
+const (
+	corsMethods = "GET, POST, OPTIONS"
+	corsHeaders = "Authorization, Content-Type, X-Request-ID"
+	corsExposed = "X-Request-ID, Retry-After"
+)
+
+// cors wraps h so that browsers on origins may call it: matching requests are
+// given an Access-Control-Allow-Origin header and preflight OPTIONS requests
+// are answered directly, ahead of any token check. An origin of * allows all
+// origins. With no origins h is returned as is and browsers block
+// cross-origin calls.
+func cors(origins []string, h http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return h
+	}
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[strings.TrimSuffix(o, "/")] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if allowed["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+		h.ServeHTTP(w, r)
+	})
+}
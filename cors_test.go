@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestCORS(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second,
+		WithCORSOrigins([]string{"https://dash.example.com"}),
+		WithToken("s3cret"),
+	))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("preflight", func(t *testing.T) {
+		res := e.OPTIONS("/example.com:443").
+			WithHeader("Origin", "https://dash.example.com").
+			WithHeader("Access-Control-Request-Method", "GET").
+			WithHeader("Access-Control-Request-Headers", "authorization").
+			Expect().
+			Status(http.StatusNoContent)
+		res.Header("Access-Control-Allow-Origin").Equal("https://dash.example.com")
+		res.Header("Access-Control-Allow-Methods").Contains("GET")
+		res.Header("Access-Control-Allow-Headers").Contains("Authorization")
+	})
+
+	t.Run("allowed origin", func(t *testing.T) {
+		res := e.GET("/xyz").
+			WithHeader("Origin", "https://dash.example.com").
+			WithHeader("Authorization", "Bearer s3cret").
+			Expect().
+			Status(http.StatusBadRequest)
+		res.Header("Access-Control-Allow-Origin").Equal("https://dash.example.com")
+		res.Header("Access-Control-Expose-Headers").Contains("X-Request-ID")
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		e.OPTIONS("/example.com:443").
+			WithHeader("Origin", "https://evil.example.com").
+			WithHeader("Access-Control-Request-Method", "GET").
+			Expect().
+			Status(http.StatusUnauthorized).
+			Header("Access-Control-Allow-Origin").Empty()
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second))
+		defer svr.Close()
+		httpexpect.New(t, svr.URL).
+			GET("/xyz").
+			WithHeader("Origin", "https://dash.example.com").
+			Expect().
+			Header("Access-Control-Allow-Origin").Empty()
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// dnsRecords are the record types dns mode can look up, mapped to the network
+// passed to LookupIP for the address records.
+var dnsRecords = map[string]string{
+	"A":     "ip4",
+	"AAAA":  "ip6",
+	"MX":    "",
+	"TXT":   "",
+	"CNAME": "",
+}
+
+// checkDNS resolves host without dialing it. With no record type every
+// address is looked up; A and AAAA limit that to one family, while MX, TXT and
+// CNAME report the matching records instead.
+func checkDNS(ctx context.Context, checker plainTest, host, record string) (int, result) {
+	resolver, ctx, cancel := checker.lookup(ctx)
+	defer cancel()
+
+	var res result
+	var err error
+	switch record {
+	case "":
+		res.ResolvedIPs, err = resolver.LookupHost(ctx, host)
+	case "A", "AAAA":
+		var ips []net.IP
+		ips, err = resolver.LookupIP(ctx, dnsRecords[record], host)
+		for _, ip := range ips {
+			res.ResolvedIPs = append(res.ResolvedIPs, ip.String())
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = resolver.LookupMX(ctx, host)
+		for _, mx := range mxs {
+			res.Records = append(res.Records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "TXT":
+		res.Records, err = resolver.LookupTXT(ctx, host)
+	case "CNAME":
+		var cname string
+		cname, err = resolver.LookupCNAME(ctx, host)
+		if err == nil {
+			res.Records = []string{cname}
+		}
+	}
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "DNS_RESOLUTION_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+		}
+	}
+	res.Status = "OK"
+	return http.StatusOK, res
+}
+
+// newResolver returns a resolver that sends every query to the DNS server at
+// addr, an ip:port, instead of those of the system.
+func newResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestDNSMode(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	// nothing listens on port 1, so only a lookup can succeed
+	t.Run("resolves without dialing", func(t *testing.T) {
+		obj := e.GET("/localhost:1").
+			WithQuery("mode", "dns").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ValueEqual("status", "OK")
+		obj.Value("resolved_ips").Array().Contains("127.0.0.1")
+		obj.NotContainsKey("latency_ms")
+	})
+
+	t.Run("A record", func(t *testing.T) {
+		e.GET("/localhost:1").
+			WithQuery("mode", "dns").
+			WithQuery("record", "A").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			Value("resolved_ips").Array().Contains("127.0.0.1")
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		e.GET("/nosuchhost.invalid:1").
+			WithQuery("mode", "dns").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "DNS_RESOLUTION_FAIL")
+	})
+
+	t.Run("unknown record type", func(t *testing.T) {
+		e.GET("/localhost:1").
+			WithQuery("mode", "dns").
+			WithQuery("record", "SRV").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_RECORD")
+	})
+
+	t.Run("record without dns mode", func(t *testing.T) {
+		e.GET("/localhost:1").
+			WithQuery("record", "A").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_RECORD")
+	})
+}
+
+// fakeDNS answers every A query with 127.0.0.1 and every other query with no
+// records, over UDP. It returns the server's address.
+func fakeDNS(t *testing.T) (string, func()) {
+	return fakeDNSWith(t, 127, 0, 0, 1)
+}
+
+// fakeDNSWith is fakeDNS answering A queries with the IPv4 addresses given as
+// consecutive groups of four bytes.
+func fakeDNSWith(t *testing.T, ips ...byte) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			// the question runs from the 12 byte header to the end of the
+			// query: a name, then a two byte type and class
+			end := 12
+			for end < len(q) && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			end += 5
+			if end > len(q) {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(q[end-4:])
+			resp := append([]byte{}, q[:end]...)
+			resp[2], resp[3] = 0x81, 0x80 // a response, recursion available
+			resp[6], resp[7] = 0, 0
+			resp[8], resp[9], resp[10], resp[11] = 0, 0, 0, 0
+			if qtype == 1 {
+				resp[7] = byte(len(ips) / 4)
+				for i := 0; i+4 <= len(ips); i += 4 {
+					resp = append(resp,
+						0xc0, 12, // the name in the question
+						0, 1, 0, 1, // A, IN
+						0, 0, 0, 60, // TTL
+						0, 4,
+					)
+					resp = append(resp, ips[i:i+4]...)
+				}
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), func() { pc.Close() }
+}
+
+func TestCustomResolver(t *testing.T) {
+	resolver, stop := fakeDNS(t)
+	defer stop()
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("resolves through the server", func(t *testing.T) {
+		obj := e.GET("/split-horizon.invalid:"+port).
+			WithQuery("resolver", resolver).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ValueEqual("status", "OK")
+		obj.ValueEqual("resolved_ips", []string{"127.0.0.1"})
+	})
+
+	t.Run("dns mode", func(t *testing.T) {
+		e.GET("/split-horizon.invalid:1").
+			WithQuery("mode", "dns").
+			WithQuery("record", "A").
+			WithQuery("resolver", resolver).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("resolved_ips", []string{"127.0.0.1"})
+	})
+
+	t.Run("system resolver by default", func(t *testing.T) {
+		e.GET("/split-horizon.invalid:"+port).
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "DNS_RESOLUTION_FAIL")
+	})
+
+	for _, bad := range []string{"8.8.8.8", "dns.google:53"} {
+		e.GET("/example.com:443").
+			WithQuery("resolver", bad).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_RESOLVER")
+	}
+	e.GET("/example.com:443").
+		WithQuery("resolver", resolver).
+		WithQuery("proxy", "127.0.0.1:3128").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_RESOLVER")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// maxDrains bounds the CONNECT response bodies discarded at once.
+const maxDrains = 64
+
+// drainer discards CONNECT response bodies in the background so checks need
+// not wait for them, with no more than cap(slots) goroutines doing so at once.
+// A body that arrives while every slot is taken, or that is given to a nil
+// drainer, is left alone: closing it would read it to the end, and closing
+// the connection under it, as the caller does, is enough.
+type drainer struct {
+	slots   chan struct{}
+	metrics *metrics
+}
+
+// newDrainer returns a drainer running at most n drains at once.
+func newDrainer(n int, m *metrics) *drainer {
+	return &drainer{slots: make(chan struct{}, n), metrics: m}
+}
+
+// drain reads and discards up to limit bytes of body, then closes it.
+func (d *drainer) drain(body io.ReadCloser, limit int64) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.slots <- struct{}{}:
+	default:
+		return
+	}
+	d.metrics.drains.Inc()
+	go func() {
+		defer func() {
+			d.metrics.drains.Dec()
+			<-d.slots
+		}()
+		io.Copy(ioutil.Discard, io.LimitReader(body, limit))
+		body.Close()
+	}()
+}
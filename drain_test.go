@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// readCounter counts the reads made of it.
+type readCounter struct {
+	io.ReadCloser
+	reads int64
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	atomic.AddInt64(&r.reads, 1)
+	return r.ReadCloser.Read(p)
+}
+
+func TestDrainer(t *testing.T) {
+	m := newMetrics()
+	d := newDrainer(1, m)
+
+	// a body that never ends until its writer is closed
+	pr, pw := io.Pipe()
+	d.drain(pr, 1<<20)
+	if n := testutil.ToFloat64(m.drains); n != 1 {
+		t.Errorf("got %v active drains, want 1", n)
+	}
+
+	// every slot is taken, so this body is left alone
+	skipped := &readCounter{ReadCloser: io.NopCloser(&io.LimitedReader{})}
+	d.drain(skipped, 1<<20)
+	if n := testutil.ToFloat64(m.drains); n != 1 {
+		t.Errorf("got %v active drains, want 1", n)
+	}
+
+	pw.Close()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(m.drains) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the drain did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&skipped.reads); n != 0 {
+		t.Errorf("the skipped body was read %d times", n)
+	}
+
+	var nilDrainer *drainer
+	nilDrainer.drain(skipped, 1<<20)
+	if n := atomic.LoadInt64(&skipped.reads); n != 0 {
+		t.Errorf("a nil drainer read the body %d times", n)
+	}
+}
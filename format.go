@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// textWriter marks a response that writeJSON should render as a single line
+// of text rather than JSON.
+type textWriter struct {
+	http.ResponseWriter
+	target string
+}
+
+func (tw *textWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// textFormat wraps h so that a request with ?format=text, or with no format
+// and an Accept header preferring text/plain, gets its result as one line:
+// the status, the target, then the latency or the error.
+func textFormat(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch format := r.URL.Query().Get("format"); format {
+		case "text":
+		case "json":
+			h.ServeHTTP(w, r)
+			return
+		case "":
+			if !prefersText(r.Header.Get("Accept")) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		default:
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "INVALID_FORMAT",
+				Error:  fmt.Sprintf("unknown format %q; use json or text", format),
+			})
+			return
+		}
+		h.ServeHTTP(&textWriter{ResponseWriter: w, target: r.URL.Path[1:]}, r)
+	})
+}
+
+// prefersText reports whether the first media type of an Accept header is
+// text/plain.
+func prefersText(accept string) bool {
+	first := strings.SplitN(accept, ",", 2)[0]
+	mediaType, _, err := mime.ParseMediaType(first)
+	return err == nil && mediaType == "text/plain"
+}
+
+// writeText writes res as the line described by textFormat.
+func writeText(tw *textWriter, code int, res result) {
+	line := res.Status + " " + tw.target
+	switch {
+	case res.Error != "":
+		line += " " + res.Error
+	case res.LatencyMS > 0:
+		d := time.Duration(res.LatencyMS * float64(time.Millisecond))
+		line += " " + d.Round(time.Microsecond).String()
+	}
+	tw.Header().Set("content-type", "text/plain;charset=utf-8")
+	tw.WriteHeader(code)
+	fmt.Fprintln(tw, line)
+}
+
+// okWriter answers with 200 OK whatever status the handler writes.
+type okWriter struct {
+	http.ResponseWriter
+}
+
+func (w *okWriter) WriteHeader(code int) {
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+func (w *okWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// httpOK wraps h so that a request with ?http-ok=true is always answered
+// with 200 OK, leaving the result's status alone to say how the check went.
+// It suits clients that take any other status to mean the service itself
+// failed.
+func httpOK(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, _ := strconv.ParseBool(r.URL.Query().Get("http-ok")); ok {
+			w = &okWriter{ResponseWriter: w}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
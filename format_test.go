@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestTextFormat(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("ok", func(t *testing.T) {
+		res := e.GET("/"+l.Addr().String()).
+			WithQuery("format", "text").
+			Expect().
+			Status(http.StatusOK)
+		res.Header("Content-Type").Contains("text/plain")
+		body := res.Body()
+		body.Match(`^OK ` + l.Addr().String() + ` [0-9.]+[µm]?s\n$`)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		e.GET("/127.0.0.1:1").
+			WithHeader("Accept", "text/plain").
+			Expect().
+			Status(http.StatusBadGateway).
+			Body().
+			Match(`^HOST_REFUSED 127.0.0.1:1 .*connection refused\n$`)
+	})
+
+	t.Run("json by default", func(t *testing.T) {
+		e.GET("/127.0.0.1:1").
+			WithHeader("Accept", "*/*").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "HOST_REFUSED")
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		e.GET("/127.0.0.1:1").
+			WithQuery("format", "xml").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_FORMAT")
+	})
+}
+
+func TestHTTPOK(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	e.GET("/127.0.0.1:1").
+		WithQuery("http-ok", "true").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "HOST_REFUSED")
+	e.GET("/127.0.0.1:1").
+		WithQuery("http-ok", "true").
+		WithQuery("format", "text").
+		Expect().
+		Status(http.StatusOK).
+		Body().
+		Match(`^HOST_REFUSED 127.0.0.1:1 `)
+	e.GET("/127.0.0.1:1").
+		WithQuery("http-ok", "true").
+		WithQuery("mode", "nope").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "INVALID_MODE")
+	// the default is unchanged
+	e.GET("/127.0.0.1:1").
+		WithQuery("http-ok", "false").
+		Expect().
+		Status(http.StatusBadGateway)
+}
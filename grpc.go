@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// checkGRPC connects to host:port and calls grpc.health.v1.Health/Check for
+// the server as a whole with the standard health client, over TLS when secure
+// is set and in plaintext otherwise. The check fails with GRPC_NOT_SERVING
+// when the server reports NOT_SERVING, and with GRPC_UNHEALTHY for any other
+// status but SERVING.
+func checkGRPC(ctx context.Context, cfg config, checker plainTest, host, port string, secure bool) (int, result) {
+	// the client may still be dialing after a timed out call returns, so
+	// everything the dialer and handshake record is guarded by mu
+	var mu sync.Mutex
+	var res result
+	var dialErr, handshakeErr error
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		h, p, err := net.SplitHostPort(addr)
+		if err == nil {
+			var c net.Conn
+			var latency time.Duration
+			if c, latency, err = checker.Connect(ctx, h, p); err == nil {
+				mu.Lock()
+				res.LatencyMS = millis(latency)
+				mu.Unlock()
+				return c, nil
+			}
+		}
+		mu.Lock()
+		dialErr = err
+		mu.Unlock()
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if secure {
+		creds = handshakeCreds{
+			TransportCredentials: credentials.NewTLS(&tls.Config{RootCAs: cfg.rootCAs}),
+			record: func(err error) {
+				mu.Lock()
+				handshakeErr = err
+				mu.Unlock()
+			},
+		}
+	}
+
+	addr := net.JoinHostPort(host, port)
+	fail := func(err error) (int, result) {
+		res.Status = "GRPC_CHECK_FAIL"
+		res.Error = err.Error()
+		res.Code = errorCode(err)
+		res.err = err
+		return http.StatusBadGateway, res
+	}
+	// passthrough leaves the address to the dialer, which resolves it as
+	// every other mode does
+	conn, err := grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(dial),
+	)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+
+	if checker.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, checker.Timeout)
+		defer cancel()
+	}
+	ctx, s := startSpan(ctx, "grpc health check", trace.SpanKindClient)
+	s.SetAttributes(attribute.String("address", addr))
+	defer s.End()
+	md := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, md)
+	for k, v := range md {
+		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+	}
+	var p peer.Peer
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p))
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		setSpanStatus(s, false, err.Error())
+		var certErr *tls.CertificateVerificationError
+		switch {
+		case dialErr != nil:
+			res.Status = "HOST_CONNECT_FAIL"
+			res.Error = dialErr.Error()
+			res.Code = errorCode(dialErr)
+			res.err = dialErr
+			return http.StatusBadGateway, res
+		case errors.As(handshakeErr, &certErr):
+			res.Status = "TLS_CERT_INVALID"
+			res.Error = handshakeErr.Error()
+			res.Code = errorCode(handshakeErr)
+			res.err = handshakeErr
+			return http.StatusBadGateway, res
+		}
+		return fail(err)
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		res.TLSVersion = tls.VersionName(info.State.Version)
+		res.CipherSuite = tls.CipherSuiteName(info.State.CipherSuite)
+	}
+
+	serving := resp.GetStatus().String()
+	res.GRPCStatus = serving
+	s.SetAttributes(attribute.String("grpc.serving_status", serving))
+	switch resp.GetStatus() {
+	case healthpb.HealthCheckResponse_SERVING:
+		setSpanStatus(s, true, "")
+		res.Status = "OK"
+		return http.StatusOK, res
+	case healthpb.HealthCheckResponse_NOT_SERVING:
+		res.Status = "GRPC_NOT_SERVING"
+	default:
+		res.Status = "GRPC_UNHEALTHY"
+	}
+	res.Error = "server is " + serving
+	setSpanStatus(s, false, res.Error)
+	return http.StatusBadGateway, res
+}
+
+// handshakeCreds are TLS transport credentials that pass the error of a
+// failed handshake to record, as the status of the call carries it only as
+// text.
+type handshakeCreds struct {
+	credentials.TransportCredentials
+	record func(error)
+}
+
+func (c handshakeCreds) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, conn)
+	if err != nil {
+		c.record(err)
+	}
+	return conn, info, err
+}
+
+func (c handshakeCreds) Clone() credentials.TransportCredentials {
+	return handshakeCreds{c.TransportCredentials.Clone(), c.record}
+}
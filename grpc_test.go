@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcHealthServer is a gRPC server whose standard health service reports
+// status for the server as a whole.
+func grpcHealthServer(status healthpb.HealthCheckResponse_ServingStatus) http.Handler {
+	hs := health.NewServer()
+	hs.SetServingStatus("", status)
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+	return gs
+}
+
+func newGRPCServer(h http.Handler) *httptest.Server {
+	ts := httptest.NewUnstartedServer(h)
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	return ts
+}
+
+func TestGRPCMode(t *testing.T) {
+	serving := newGRPCServer(grpcHealthServer(healthpb.HealthCheckResponse_SERVING))
+	defer serving.Close()
+	notServing := newGRPCServer(grpcHealthServer(healthpb.HealthCheckResponse_NOT_SERVING))
+	defer notServing.Close()
+	tlsServer := httptest.NewUnstartedServer(grpcHealthServer(healthpb.HealthCheckResponse_SERVING))
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("serving", func(t *testing.T) {
+		e.GET("/"+serving.Listener.Addr().String()).
+			WithQuery("mode", "grpc").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":      "OK",
+				"grpc_status": "SERVING",
+			}).
+			ContainsKey("latency_ms")
+	})
+
+	t.Run("not serving", func(t *testing.T) {
+		e.GET("/"+notServing.Listener.Addr().String()).
+			WithQuery("mode", "grpc").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":      "GRPC_NOT_SERVING",
+				"grpc_status": "NOT_SERVING",
+			})
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		e.GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "grpc").
+			WithQuery("tls", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":      "OK",
+				"grpc_status": "SERVING",
+				"tls_version": "TLS 1.3",
+			})
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second))
+		defer svr.Close()
+		httpexpect.New(t, svr.URL).
+			GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "grpc").
+			WithQuery("tls", "true").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "TLS_CERT_INVALID")
+	})
+
+	t.Run("no health service", func(t *testing.T) {
+		// the server answers trailers-only with UNIMPLEMENTED
+		bare := newGRPCServer(grpc.NewServer())
+		defer bare.Close()
+		e.GET("/"+bare.Listener.Addr().String()).
+			WithQuery("mode", "grpc").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "GRPC_CHECK_FAIL").
+			Value("error").String().Contains("Unimplemented")
+	})
+
+	t.Run("not a gRPC server", func(t *testing.T) {
+		e.GET("/"+plain.Listener.Addr().String()).
+			WithQuery("mode", "grpc").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "GRPC_CHECK_FAIL")
+	})
+
+	t.Run("tls without grpc", func(t *testing.T) {
+		e.GET("/"+serving.Listener.Addr().String()).
+			WithQuery("tls", "true").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_MODE")
+	})
+}
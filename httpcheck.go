@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxRedirects bounds the redirects followed in http mode.
+const maxRedirects = 10
+
+var (
+	errRedirectLoop     = errors.New("redirect loop")
+	errTooManyRedirects = fmt.Errorf("stopped after %d redirects", maxRedirects)
+)
+
+// redirectDenied reports a redirect to a target the service may not check.
+type redirectDenied struct {
+	status string
+	err    error
+}
+
+func (e *redirectDenied) Error() string { return "redirect: " + e.err.Error() }
+
+// checkHTTP connects to host:port and issues a GET for path, over TLS when
+// secure is set. The check fails with HTTP_UNHEALTHY when the server answers
+// with a 5xx status. Redirects are reported as they are unless follow is set,
+// in which case up to maxRedirects of them are followed, each screened like
+// the target, and the last status is reported along with its URL.
+func checkHTTP(ctx context.Context, cfg config, checker plainTest, host, port, path string, secure, follow bool) (int, result) {
+	if path == "" {
+		path = "/"
+	}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: path}
+	if secure {
+		u.Scheme = "https"
+	}
+
+	// the transport may still be dialing after a timed out request returns,
+	// so everything the dialers record is guarded by mu
+	var mu sync.Mutex
+	var res result
+	var dialErr, tlsErr error
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		h, p, err := net.SplitHostPort(addr)
+		if err == nil {
+			var c net.Conn
+			var latency time.Duration
+			if c, latency, err = checker.Connect(ctx, h, p); err == nil {
+				mu.Lock()
+				if res.LatencyMS == 0 {
+					res.LatencyMS = millis(latency)
+				}
+				mu.Unlock()
+				return c, nil
+			}
+		}
+		mu.Lock()
+		dialErr = err
+		mu.Unlock()
+		return nil, err
+	}
+	tr := &http.Transport{
+		DialContext:       dial,
+		DisableKeepAlives: true,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			h, _, _ := net.SplitHostPort(addr)
+			conn := tls.Client(c, &tls.Config{
+				ServerName: h,
+				RootCAs:    cfg.rootCAs,
+			})
+			_, s := startSpan(ctx, "tls handshake", trace.SpanKindClient)
+			err = conn.HandshakeContext(ctx)
+			setSpanStatus(s, err == nil, fmt.Sprint(err))
+			s.End()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				c.Close()
+				tlsErr = err
+				return nil, err
+			}
+			state := conn.ConnectionState()
+			res.TLSVersion = tls.VersionName(state.Version)
+			res.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+			return conn, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   checker.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !follow {
+				return http.ErrUseLastResponse
+			}
+			for _, prev := range via {
+				if prev.URL.String() == req.URL.String() {
+					return errRedirectLoop
+				}
+			}
+			if len(via) > maxRedirects {
+				return errTooManyRedirects
+			}
+			if status, err := cfg.screen(req.URL.Hostname(), "", checker.Timeout); err != nil {
+				return &redirectDenied{status, err}
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HTTP_REQUEST_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+		}
+	}
+	req.Header = cfg.requestHeader()
+	sctx, s := startSpan(ctx, "http request", trace.SpanKindClient)
+	s.SetAttributes(attribute.String("url", u.String()))
+	defer s.End()
+	tracePropagator.Inject(sctx, propagation.HeaderCarrier(req.Header))
+	resp, err := client.Do(req)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		setSpanStatus(s, false, err.Error())
+		res.Error = err.Error()
+		res.Code = errorCode(err)
+		res.err = err
+		var certErr *tls.CertificateVerificationError
+		var denied *redirectDenied
+		switch {
+		case errors.Is(err, errRedirectLoop):
+			res.Status = "HTTP_REDIRECT_LOOP"
+		case errors.Is(err, errTooManyRedirects):
+			res.Status = "HTTP_TOO_MANY_REDIRECTS"
+		case errors.As(err, &denied):
+			res.Status = denied.status
+			return http.StatusForbidden, res
+		case dialErr != nil:
+			res.Status = "HOST_CONNECT_FAIL"
+			res.Error = dialErr.Error()
+			res.Code = errorCode(dialErr)
+			res.err = dialErr
+		case errors.As(tlsErr, &certErr):
+			res.Status = "TLS_CERT_INVALID"
+		case tlsErr != nil:
+			res.Status = "TLS_HANDSHAKE_FAIL"
+		default:
+			res.Status = "HTTP_REQUEST_FAIL"
+		}
+		return http.StatusBadGateway, res
+	}
+	resp.Body.Close()
+
+	res.HTTPStatus = resp.StatusCode
+	if follow {
+		res.FinalURL = resp.Request.URL.String()
+	}
+	s.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	setSpanStatus(s, resp.StatusCode < 500, resp.Status)
+	if resp.StatusCode >= 500 {
+		res.Status = "HTTP_UNHEALTHY"
+		res.Error = resp.Status
+		return http.StatusBadGateway, res
+	}
+	res.Status = "OK"
+	return http.StatusOK, res
+}
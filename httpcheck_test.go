@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestHTTPMode(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/moved":
+			http.Redirect(w, r, "/", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			fmt.Fprintln(w, "OK")
+		}
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("healthy", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "http").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("http_status", http.StatusOK)
+	})
+
+	t.Run("unhealthy", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "http").
+			WithQuery("path", "/broken").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "HTTP_UNHEALTHY").
+			ValueEqual("http_status", http.StatusServiceUnavailable)
+	})
+
+	t.Run("redirect not followed", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "http").
+			WithQuery("path", "/moved").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("http_status", http.StatusFound)
+	})
+
+	t.Run("redirect followed", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "http").
+			WithQuery("path", "/moved").
+			WithQuery("follow", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("http_status", http.StatusOK).
+			ValueEqual("final_url", ts.URL+"/")
+	})
+
+	t.Run("redirect loop", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "http").
+			WithQuery("path", "/loop").
+			WithQuery("follow", "true").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "HTTP_REDIRECT_LOOP")
+	})
+
+	t.Run("follow in tcp mode", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("follow", "true").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_MODE")
+	})
+
+	t.Run("https", func(t *testing.T) {
+		e.GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "https").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("http_status", http.StatusOK).
+			ContainsKey("tls_version")
+	})
+
+	t.Run("https to a plain server", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "https").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "TLS_HANDSHAKE_FAIL")
+	})
+
+	t.Run("host unreachable", func(t *testing.T) {
+		e.GET("/127.0.0.1:1").
+			WithQuery("mode", "http").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "HOST_CONNECT_FAIL")
+	})
+
+	t.Run("invalid path", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "http").
+			WithQuery("path", "broken").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_PATH")
+	})
+}
+
+func TestRequestHeaders(t *testing.T) {
+	got := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+	}))
+	defer ts.Close()
+
+	// answers a single CONNECT, reporting its headers
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		c, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		got <- req.Header
+		fmt.Fprint(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	}()
+
+	header := headerFlag{}
+	for _, v := range []string{"X-Probe: 1", "X-Probe: 2", "Accept: text/plain"} {
+		if err := header.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svr := httptest.NewServer(Run(time.Second, WithUserAgent("willitgo-probe/1.0"), WithRequestHeaders(http.Header(header))))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	check := func(name string, h http.Header) {
+		for k, exp := range map[string][]string{
+			"User-Agent": {"willitgo-probe/1.0"},
+			"X-Probe":    {"1", "2"},
+			"Accept":     {"text/plain"},
+		} {
+			if !reflect.DeepEqual(exp, h[k]) {
+				_, file, line, _ := runtime.Caller(1)
+				t.Logf("%s:%d: %s %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, name, k, exp, h[k])
+				t.Fail()
+			}
+		}
+	}
+
+	e.GET("/"+ts.Listener.Addr().String()).
+		WithQuery("mode", "http").
+		Expect().
+		Status(http.StatusOK)
+	check("http", <-got)
+
+	e.GET("/"+ts.Listener.Addr().String()).
+		WithQuery("proxy", proxy.Addr().String()).
+		Expect().
+		Status(http.StatusOK)
+	check("CONNECT", <-got)
+}
+
+func TestHeaderFlag(t *testing.T) {
+	for _, v := range []string{"X-Probe", "Bad Name: 1", "X-Probe: a\x00b", "Host: example.com"} {
+		if err := (headerFlag{}).Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// limitConcurrency wraps h so that at most cap(sem) requests sharing sem are
+// served at once. Requests beyond that are turned away with 503 BUSY rather
+// than queued. A nil sem disables the limit.
+func limitConcurrency(sem chan struct{}, h http.Handler) http.Handler {
+	if sem == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+		default:
+			inFlight := len(sem)
+			writeJSON(w, http.StatusServiceUnavailable, result{
+				Status:   "BUSY",
+				Error:    fmt.Sprintf("%d checks already in flight", inFlight),
+				InFlight: inFlight,
+			})
+			return
+		}
+		defer func() { <-sem }()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// retryAfterWriter adds a Retry-After header to 503 and 504 responses.
+type retryAfterWriter struct {
+	http.ResponseWriter
+	seconds string
+}
+
+func (w *retryAfterWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout {
+		w.Header().Set("Retry-After", w.seconds)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *retryAfterWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (w *retryAfterWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// retryAfter wraps h so that BUSY and timed out responses tell clients to
+// back off for d, rounded up to whole seconds. A zero d leaves responses
+// alone.
+func retryAfter(d time.Duration, h http.Handler) http.Handler {
+	if d <= 0 {
+		return h
+	}
+	seconds := strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&retryAfterWriter{ResponseWriter: w, seconds: seconds}, r)
+	})
+}
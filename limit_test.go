@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	// The proxy accepts the tunnel request and never answers it, holding the
+	// first check in flight.
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c
+	}()
+
+	svr := httptest.NewServer(Run(time.Second, WithMaxConcurrent(1)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		http.Get(svr.URL + "/example.com:80?proxy=" + proxy.Addr().String())
+	}()
+	c := <-accepted
+
+	busy := e.GET("/example.com:80").
+		Expect().
+		Status(http.StatusServiceUnavailable)
+	busy.Header("Retry-After").Equal("5")
+	busy.JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status":    "BUSY",
+			"in_flight": 1,
+		})
+	e.POST("/batch").
+		Expect().
+		Status(http.StatusServiceUnavailable).
+		JSON().Object().
+		ValueEqual("status", "BUSY")
+
+	c.Close()
+	<-done
+	e.GET("/xyz").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_HOST")
+}
+
+func TestRetryAfter(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/timeout":
+			writeJSON(w, http.StatusGatewayTimeout, result{Status: "HOST_CONNECT_TIMEOUT"})
+		case "/busy":
+			writeJSON(w, http.StatusServiceUnavailable, result{Status: "BUSY"})
+		default:
+			writeJSON(w, http.StatusBadGateway, result{Status: "HOST_CONNECT_FAIL"})
+		}
+	})
+	svr := httptest.NewServer(retryAfter(1500*time.Millisecond, h))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	timeout := e.GET("/timeout").Expect().Status(http.StatusGatewayTimeout)
+	timeout.Header("Retry-After").Equal("2")
+	timeout.JSON().Object().ValueEqual("status", "HOST_CONNECT_TIMEOUT")
+	e.GET("/busy").Expect().Header("Retry-After").Equal("2")
+	e.GET("/fail").Expect().Header("Retry-After").Empty()
+
+	svr.Config.Handler = retryAfter(0, h)
+	e.GET("/timeout").Expect().Header("Retry-After").Empty()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestID tags every request with an ID, taken from the X-Request-ID header
+// or generated when absent, and echoes it back in the same header. writeJSON
+// copies it into the result.
+func requestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newUUID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// resultRecorder remembers the response code and the status and error of the
+// result written through it by writeJSON.
+type resultRecorder struct {
+	http.ResponseWriter
+	code    int
+	status  string
+	err     string
+	errCode string
+	chain   []string
+}
+
+func (rec *resultRecorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *resultRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (rec *resultRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordResult notes res on every resultRecorder wrapping w.
+func recordResult(w http.ResponseWriter, res result) {
+	for {
+		if rec, ok := w.(*resultRecorder); ok {
+			rec.status = res.Status
+			rec.err = res.Error
+			rec.errCode = res.Code
+			rec.chain = errorChain(res.err)
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// accessLog wraps h, logging each request once it has been served. With a
+// nil logger the request is logged as a plain line through the log package.
+func accessLog(logger *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &resultRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+		proxy := r.URL.Query().Get("proxy")
+		id := w.Header().Get(requestIDHeader)
+		if logger == nil {
+			log.Println(r.URL.Path[1:], proxy, time.Since(start).String(), id, rec.err)
+			return
+		}
+		host, port, err := parseTarget(r.URL.Path[1:])
+		if err != nil {
+			host = r.URL.Path[1:]
+		}
+		logger.Info("check",
+			"request_id", id,
+			"host", host,
+			"port", port,
+			"proxy", proxy,
+			"status", rec.status,
+			"latency_ms", millis(time.Since(start)),
+			"code", rec.code,
+			"error", rec.err,
+			"error_code", rec.errCode,
+			"error_chain", rec.chain,
+		)
+	})
+}
+
+// errorChain lists err and every error it wraps, outermost first, each with
+// its type, so that a root cause such as a syscall.Errno shows in the log
+// however the layers above it word their messages. Errors that wrap several
+// others are followed depth first.
+func errorChain(err error) []string {
+	var chain []string
+	var walk func(error)
+	walk = func(err error) {
+		if err == nil {
+			return
+		}
+		chain = append(chain, fmt.Sprintf("%T: %v", err, err))
+		switch u := err.(type) {
+		case interface{ Unwrap() error }:
+			walk(u.Unwrap())
+		case interface{ Unwrap() []error }:
+			for _, err := range u.Unwrap() {
+				walk(err)
+			}
+		}
+	}
+	walk(err)
+	return chain
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	svr := httptest.NewServer(Run(time.Second, WithLogger(logger)))
+	defer svr.Close()
+
+	httpexpect.New(t, svr.URL).
+		GET("/127.0.0.1:1").
+		Expect().
+		StatusRange(httpexpect.Status5xx)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	if _, ok := entry["latency_ms"].(float64); !ok {
+		t.Errorf("latency_ms missing from %v", entry)
+	}
+	for k, expected := range map[string]interface{}{
+		"msg":        "check",
+		"host":       "127.0.0.1",
+		"port":       "1",
+		"proxy":      "",
+		"status":     "HOST_REFUSED",
+		"code":       float64(http.StatusBadGateway),
+		"error_code": "ERR_REFUSED",
+	} {
+		actual := entry[k]
+		if !reflect.DeepEqual(expected, actual) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, k, expected, actual)
+			t.Fail()
+		}
+	}
+	checkErrorChain(t, entry, "syscall.Errno: connection refused")
+}
+
+func TestAccessLogProxyError(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	svr := httptest.NewServer(Run(time.Second, WithLogger(logger)))
+	defer svr.Close()
+
+	httpexpect.New(t, svr.URL).
+		GET("/example.com:443").
+		WithQuery("proxy", "127.0.0.1:1").
+		Expect().
+		Status(http.StatusBadRequest)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	if expected, actual := "ERR_REFUSED", entry["error_code"]; expected != actual {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d: error_code\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, expected, actual)
+		t.Fail()
+	}
+	checkErrorChain(t, entry, "syscall.Errno: connection refused")
+}
+
+// checkErrorChain fails t unless the error_chain of the log entry ends with
+// root.
+func checkErrorChain(t *testing.T, entry map[string]interface{}, root string) {
+	t.Helper()
+	chain, _ := entry["error_chain"].([]interface{})
+	if len(chain) == 0 || chain[len(chain)-1] != root {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d: error_chain\n\n\texp: ending %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, root, chain)
+		t.Fail()
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	svr := httptest.NewServer(Run(time.Second, WithLogger(logger)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("echoes incoming id", func(t *testing.T) {
+		buf.Reset()
+		res := e.GET("/xyz").
+			WithHeader("X-Request-ID", "trace-123").
+			Expect()
+		res.Header("X-Request-ID").Equal("trace-123")
+		res.JSON().Object().ValueEqual("request_id", "trace-123")
+
+		var entry map[string]interface{}
+		json.Unmarshal(buf.Bytes(), &entry)
+		if entry["request_id"] != "trace-123" {
+			t.Errorf("request_id missing from log entry %v", entry)
+		}
+	})
+
+	t.Run("generates an id", func(t *testing.T) {
+		res := e.GET("/xyz").Expect()
+		id := res.Header("X-Request-ID").NotEmpty().Raw()
+		res.JSON().Object().ValueEqual("request_id", id)
+	})
+}
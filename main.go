@@ -2,90 +2,1415 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type result struct {
 	Status string `json:"status"`
+	// Target is the host:port, or unix:path, that was checked, as the
+	// request gave it when it could not be parsed.
+	Target string `json:"target,omitempty"`
 	Error  string `json:"error,omitempty"`
-	Proxy  string `json:"proxy,omitempty"`
+	// Code classifies the cause of Error, when it is recognised, in terms
+	// that stay the same from one release to the next; see errorCode.
+	Code      string `json:"code,omitempty"`
+	Proxy     string `json:"proxy,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// LatencyMS is the time taken to establish the TCP connection to the
+	// target, or to the proxy when one is used.
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	// ConnectMS is the time taken for the proxy to answer the tunnel request.
+	ConnectMS float64 `json:"connect_ms,omitempty"`
+	// ProxyReused is set when the check reused an idle connection to the
+	// proxy rather than dialing a new one.
+	ProxyReused bool `json:"proxy_reused,omitempty"`
+	// ProxyHeaders holds the allowlisted headers of the proxy's CONNECT
+	// response.
+	ProxyHeaders map[string]string `json:"proxy_headers,omitempty"`
+	// ProxyStatusText is the reason phrase of a proxy's failed CONNECT
+	// response, such as Forbidden.
+	ProxyStatusText string `json:"proxy_status_text,omitempty"`
+	// ProxyAttempts lists the proxies of a fallback chain that failed, in
+	// the order they were tried.
+	ProxyAttempts []proxyAttempt `json:"proxy_attempts,omitempty"`
+
+	TLSVersion  string `json:"tls_version,omitempty"`
+	CipherSuite string `json:"cipher_suite,omitempty"`
+	// ALPNNegotiated is the protocol the server picked, in tls mode, from
+	// those offered with ?alpn=; empty when it picked none.
+	ALPNNegotiated string `json:"alpn_negotiated,omitempty"`
+	// CertNotAfter and CertDaysRemaining describe the expiry of the leaf
+	// certificate presented in tls mode.
+	CertNotAfter      string `json:"cert_not_after,omitempty"`
+	CertDaysRemaining *int   `json:"cert_days_remaining,omitempty"`
+	Warning           string `json:"warning,omitempty"`
+	// MTLS reports, in tls mode, whether the server accepted our client
+	// certificate. It is only set when the server asked for one.
+	MTLS *bool `json:"mtls,omitempty"`
+	// HTTPStatus is the status code returned in the http, https, ws and wss
+	// modes.
+	HTTPStatus int `json:"http_status,omitempty"`
+	// FinalURL is where the redirects followed in http mode led.
+	FinalURL string `json:"final_url,omitempty"`
+	// GRPCStatus is the serving status reported in grpc mode.
+	GRPCStatus string `json:"grpc_status,omitempty"`
+	// SMTPCode is the reply code of the last command in smtp mode.
+	SMTPCode int `json:"smtp_code,omitempty"`
+	// Banner is the greeting the server sent in smtp mode, or its
+	// identification string in ssh mode.
+	Banner string `json:"banner,omitempty"`
+	// StartTLS reports whether the server offers STARTTLS, once asked in
+	// smtp mode.
+	StartTLS *bool `json:"starttls,omitempty"`
+	// Note qualifies what the status means, e.g. for connectionless checks.
+	Note string `json:"note,omitempty"`
+	// Attempts is the number of dials made when retries were requested.
+	Attempts int `json:"attempts,omitempty"`
+	// ResolvedIPs lists the addresses the target host resolved to.
+	ResolvedIPs []string `json:"resolved_ips,omitempty"`
+	// Family is the address family, ip4 or ip6, of the connection made.
+	Family string `json:"family,omitempty"`
+	// LocalAddr and RemoteAddr are the two ends of the connection made.
+	LocalAddr  string `json:"local_addr,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Records holds the MX, TXT or CNAME records found in dns mode.
+	Records []string `json:"records,omitempty"`
+	// IPs holds, with ?all-ips=, how each address of the host fared.
+	IPs []ipResult `json:"ips,omitempty"`
+	// Received is, in hex, the reply read for ?expect=.
+	Received string `json:"received,omitempty"`
+	// Method is how scan mode probed the port: always full-connect, a
+	// complete TCP handshake closed at once, as no SYN-only scan is made.
+	Method string `json:"method,omitempty"`
+	// InFlight is the number of checks running when a request is turned
+	// away as BUSY.
+	InFlight int `json:"in_flight,omitempty"`
+	// err is the error behind Error, when there is one, kept for the access
+	// log to unwrap.
+	err error
+	// Errno is, with ?raw-error=, the number of the system call error the
+	// check failed with, such as 111 for ECONNREFUSED on Linux.
+	Errno int `json:"errno,omitempty"`
+	// Cached is set when the result is that of an identical check running at
+	// the same time or, with WithCacheTTL, made shortly before, served
+	// without dialing again.
+	Cached bool `json:"cached,omitempty"`
+}
+
+// millis converts d to fractional milliseconds.
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
 }
 
 func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if res, ok := v.(result); ok {
+		res.RequestID = w.Header().Get(requestIDHeader)
+		recordResult(w, res)
+		if tw, ok := w.(*textWriter); ok {
+			writeText(tw, code, res)
+			return
+		}
+		v = res
+	}
 	w.Header().Set("content-type", "application/json;charset=utf-8")
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(v)
 }
 
-func Run(timeout time.Duration) http.Handler {
+func Run(timeout time.Duration, opts ...Option) http.Handler {
 	// timeout := time.Second * 5
-	withProxy := proxyHandler{Timeout: timeout}
-	checker := plainTest{
-		Dialer: net.Dialer{
-			KeepAlive: 0,
-			Timeout:   timeout},
+	cfg := newConfig(opts)
+	cfg.metrics = newMetrics()
+	cfg.proxyPool = newProxyPool(cfg.proxyIdle, cfg.metrics)
+	cfg.drainer = newDrainer(maxDrains, cfg.metrics)
+	cfg.cache = newResultCache(cfg.cacheTTL, cfg.metrics)
+	plain := func(timeout time.Duration) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if path, ok := unixTarget(r.URL.Path[1:]); ok {
+				t := queryTarget(r)
+				t.Host, t.Proto = path, "unix"
+				code, res := checkTarget(r.Context(), cfg, timeout, t)
+				writeJSON(w, code, res)
+				return
+			}
+			host, port, err := parseTarget(r.URL.Path[1:])
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, result{
+					Status: "INVALID_HOST",
+					Target: r.URL.Path[1:],
+					Error:  err.Error(),
+					Code:   errorCode(err),
+				})
+				return
+			}
+			t := queryTarget(r)
+			t.Host, t.Port = host, port
+			code, res := checkTarget(r.Context(), cfg, timeout, t)
+			writeJSON(w, code, res)
+		})
 	}
-	plain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		write := func(status string, code int) {
-			writeJSON(w, code, result{
-				Status: status,
+	check := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "MISSING_TARGET",
+				Error:  "put the target to check in the path, as in /example.com:443 or /unix:/var/run/app.sock; /modes lists the check options",
 			})
+			return
 		}
-		host, port, err := net.SplitHostPort(r.URL.Path[1:])
+		timeout, err := requestTimeout(r, timeout, cfg.maxTimeout)
 		if err != nil {
 			writeJSON(w, http.StatusBadRequest, result{
-				Status: "INVALID_HOST",
+				Status: "INVALID_TIMEOUT",
+				Target: r.URL.Path[1:],
 				Error:  err.Error(),
+				Code:   errorCode(err),
 			})
 			return
 		}
-		if err := checker.Check(host, port); err != nil {
-			writeJSON(w, http.StatusBadGateway, result{
-				Status: "HOST_CONNECT_FAIL",
+
+		if status, err := cfg.withDefaultMode(queryTarget(r)).validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: status,
+				Target: r.URL.Path[1:],
 				Error:  err.Error(),
+				Code:   errorCode(err),
 			})
 			return
 		}
-		write("OK", http.StatusOK)
-	})
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func(start time.Time) {
-			log.Println(r.URL.Path[1:], r.URL.Query().Get("proxy"), time.Since(start).String())
-		}(time.Now())
-
-		var h http.Handler
-		if r.URL.Query().Get("proxy") != "" {
-			h = withProxy
-		} else {
-			h = plain
+
+		host, port, err := parseTarget(r.URL.Path[1:])
+		if err == nil {
+			proxy := r.URL.Query().Get("proxy")
+			if status, err := cfg.screen(host, proxy, timeout); err != nil {
+				writeJSON(w, http.StatusForbidden, result{
+					Status: status,
+					Target: r.URL.Path[1:],
+					Error:  err.Error(),
+					Code:   errorCode(err),
+					Proxy:  proxy,
+				})
+				return
+			}
+		}
+		if err == nil && strings.Contains(port, "-") {
+			first, last, err := parsePortRange(port)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, result{
+					Status: "INVALID_PORT_RANGE",
+					Target: r.URL.Path[1:],
+					Error:  err.Error(),
+					Code:   errorCode(err),
+				})
+				return
+			}
+			t := queryTarget(r)
+			t.Host = host
+			writeJSON(w, http.StatusOK, checkPortRange(r.Context(), cfg, timeout, t, first, last))
+			return
 		}
-		h.ServeHTTP(w, r)
+
+		plain(timeout).ServeHTTP(w, r)
 	})
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.healthPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, result{Status: "UP"})
+	}))
+	mux.Handle("/readyz", readyHandler(timeout, cfg))
+	mux.Handle("/metrics", cfg.metrics)
+	mux.HandleFunc("/stats", cfg.metrics.serveStats)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+	mux.HandleFunc("/modes", modesHandler)
+	if cfg.pprof {
+		mux.Handle("/debug/pprof/", requireToken(cfg.token, http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", requireToken(cfg.token, http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", requireToken(cfg.token, http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", requireToken(cfg.token, http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", requireToken(cfg.token, http.HandlerFunc(pprof.Trace)))
+	}
+	var sem chan struct{}
+	if cfg.maxConcurrent > 0 {
+		sem = make(chan struct{}, cfg.maxConcurrent)
+	}
+	mux.Handle("/batch", requireToken(cfg.token, limitConcurrency(sem,
+		traceRequests(cfg.tracerProvider, "batch", batchHandler(timeout, cfg)))))
+	mux.Handle("/proxytest/", requireToken(cfg.token, limitConcurrency(sem,
+		traceRequests(cfg.tracerProvider, "proxytest", proxyTestHandler(timeout, cfg)))))
+	mux.Handle("/stream", requireToken(cfg.token, limitConcurrency(sem,
+		traceRequests(cfg.tracerProvider, "stream", streamHandler(timeout, cfg)))))
+	mux.Handle("/", requireToken(cfg.token, limitConcurrency(sem,
+		traceRequests(cfg.tracerProvider, "check", cfg.metrics.instrument(accessLog(cfg.logger, httpOK(textFormat(check))))))))
+	return requestID(cors(cfg.corsOrigins, retryAfter(cfg.retryAfter, mux)))
+}
+
+// parseTarget splits a host:port target taken from the request path. IPv6
+// literals must be bracketed, as in [2606:4700:4700::1111]:443, and are
+// returned without brackets so they can be rejoined with net.JoinHostPort.
+// The host must not be empty, and a numeric port must be within 1-65535; port
+// ranges are left to parsePortRange. Paths come percent-decoded from net/http,
+// so /example.com%3A443 arrives as example.com:443; they are not decoded a
+// second time, which would turn the %25 of an escaped IPv6 zone into an
+// escape of its own.
+func parseTarget(s string) (host, port string, err error) {
+	if err := sanitizeTarget(s); err != nil {
+		return "", "", err
+	}
+	if _, ok := unixTarget(s); ok {
+		return "", "", &net.AddrError{Err: "unix socket, not host:port", Addr: s}
+	}
+	host, port, err = net.SplitHostPort(s)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" {
+		return "", "", &net.AddrError{Err: "missing host", Addr: s}
+	}
+	if strings.Contains(host, ":") && net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+		return "", "", &net.AddrError{Err: "invalid IPv6 address", Addr: s}
+	}
+	if n, err := strconv.Atoi(port); err == nil && (n < 1 || n > 65535) {
+		return "", "", &net.AddrError{Err: "port must be within 1-65535", Addr: s}
+	}
+	return host, port, nil
+}
+
+// checkAddress checks the host and port of t, or the socket path of a unix
+// target, as parseTarget and unixTarget check those taken from a request path.
+// Targets decoded from a JSON body come with neither check made.
+func (t target) checkAddress() error {
+	if t.Proto == "unix" {
+		if _, ok := unixTarget("unix:" + t.Host); !ok {
+			return &net.AddrError{Err: "invalid unix socket path", Addr: t.Host}
+		}
+		return nil
+	}
+	_, _, err := parseTarget(net.JoinHostPort(t.Host, t.Port))
+	return err
+}
+
+// unixTarget returns the socket path of a unix:/path/to.sock target. A target
+// that fails sanitizeTarget is not one.
+func unixTarget(s string) (path string, ok bool) {
+	path, ok = strings.CutPrefix(s, "unix:")
+	return path, ok && path != "" && sanitizeTarget(s) == nil
+}
+
+// maxTargetLength bounds the targets taken from request paths, well above the
+// longest host name, port range or socket path.
+const maxTargetLength = 1024
+
+// sanitizeTarget rejects targets that are too long or contain whitespace or
+// control characters, none of which a host, port or socket path needs.
+func sanitizeTarget(s string) error {
+	if len(s) > maxTargetLength {
+		return &net.AddrError{Err: fmt.Sprintf("target is longer than %d bytes", maxTargetLength), Addr: s[:64] + "..."}
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return &net.AddrError{Err: "target contains whitespace or control characters", Addr: strconv.Quote(s)}
+		}
+	}
+	return nil
+}
+
+// requestTimeout returns the ?timeout= override for r, capped at max, or
+// fallback when the parameter is absent.
+func requestTimeout(r *http.Request, fallback, max time.Duration) (time.Duration, error) {
+	return requestDuration(r, "timeout", fallback, max)
+}
+
+// requestDuration returns the duration in the query parameter name of r,
+// capped at max, or fallback when the parameter is absent.
+func requestDuration(r *http.Request, name string, fallback, max time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s %q must be positive", name, v)
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d, nil
+}
+
+// envOr returns the value of the environment variable key, or fallback when
+// it is unset or empty.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
 }
 
 func main() {
-	log.Println(http.ListenAndServe(":8080", Run(time.Second*5)))
+	var addrs listFlag
+	flag.Var(&addrs, "addr", "listen addresses, all served alike; repeatable or comma-separated; defaults to $LISTEN_ADDR when set, else :8080")
+	timeout := flag.Duration("timeout", time.Second*5, "per-check timeout, e.g. 2s or 500ms")
+	maxTimeout := flag.Duration("max-timeout", time.Second*30, "upper bound for the ?timeout= request override")
+	batchWorkers := flag.Int("batch-workers", 10, "concurrent checks per /batch request")
+	maxBatchTargets := flag.Int("max-batch-targets", 1000, "targets a single /batch or /stream request may list before answering 413 TOO_MANY_TARGETS")
+	maxConcurrent := flag.Int("max-concurrent", 100, "check requests served at once before answering 503 BUSY; 0 for no limit")
+	enablePprof := flag.Bool("pprof", false, "serve runtime profiles under /debug/pprof/; they reveal the command line and internals and profiling costs CPU, so set -token or keep the port private")
+	canary := flag.String("canary", "", "host:port that /readyz dials to confirm outbound connections work; /readyz always succeeds when unset")
+	retryAfter := flag.Duration("retry-after", 5*time.Second, "Retry-After hint sent with 503 BUSY and 504 timeout responses; 0 omits it")
+	defaultMode := flag.String("default-mode", "tcp", "mode of the checks that give no ?mode=, over proto tcp; through a proxy it runs over the tunnel, so checks needing proxy-http2, a fallback chain or other tcp-only options must ask for ?mode=tcp")
+	certWarning := flag.Duration("cert-warning", 30*24*time.Hour, "warn in tls mode when the certificate expires within this window")
+	logFormat := flag.String("log-format", "text", "access log format: text for the plain log lines, or json")
+	token := flag.String("token", envOr("API_TOKEN", ""), "require this bearer token on check endpoints; defaults to $API_TOKEN")
+	proxyHeaders := flag.String("proxy-headers", "Via,X-Cache", "comma-separated CONNECT response headers to report in proxy_headers")
+	proxyDrainLimit := flag.Int64("proxy-drain-limit", defaultDrainLimit, "most bytes of a CONNECT response body to read and discard")
+	proxyTimeout := flag.Duration("proxy-timeout", 0, "most time to spend dialing a proxy, within the check timeout; 0 allows the whole check timeout")
+	cacheTTL := flag.Duration("cache-ttl", 0, "answer identical checks made within this long of each other with the first one's result, marked cached; 0 disables caching")
+	dialKeepAlive := flag.Duration("dial-keepalive", 0, "TCP keep-alive period of check connections; 0 keeps the default of 15s, negative turns keep-alives off")
+	fallbackDelay := flag.Duration("fallback-delay", 0, "how long a dial to a host name tries IPv6 before racing IPv4 (Happy Eyeballs); 0 keeps the default of 300ms, negative turns the race off")
+	proxyPoolIdle := flag.Duration("proxy-pool-idle", 0, "reuse proxy connections left open after a refused CONNECT for up to this long; 0 disables pooling")
+	useEnvProxy := flag.Bool("use-env-proxy", false, "check targets without ?proxy= through $HTTPS_PROXY, honouring $NO_PROXY")
+	denyPrivate := flag.Bool("deny-private", false, "refuse targets and proxies resolving to private, loopback or link-local addresses")
+	var corsOrigins listFlag
+	flag.Var(&corsOrigins, "cors-origin", "let browsers on these origins, or * for any, call the service; repeatable or comma-separated; off by default")
+	var allow listFlag
+	flag.Var(&allow, "allow", "restrict targets to these CIDRs, IPs or host name suffixes; repeatable or comma-separated")
+	userAgent := flag.String("user-agent", "", "User-Agent of the requests made in http, https, ws and wss modes and of proxy CONNECTs; Go's, and none for CONNECTs, when unset")
+	header := headerFlag{}
+	flag.Var(header, "header", "a \"Name: Value\" header to add to the requests made in http, https, ws and wss modes and to proxy CONNECTs; repeatable")
+	grace := flag.Duration("shutdown-grace", time.Second*10, "how long to let in-flight checks finish on SIGINT/SIGTERM")
+	tlsCert := flag.String("tls-cert", "", "serve HTTPS using this certificate file; requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "private key file for -tls-cert")
+	clientCert := flag.String("client-cert", "", "client certificate file presented in tls mode when the server asks for one; requires -client-key")
+	clientKey := flag.String("client-key", "", "private key file for -client-cert")
+	checkAddr := flag.String("check", "", "check this host:port once, print the result as JSON and exit: 0 if OK, 1 if the check failed, 2 if it was invalid or not allowed")
+	checkProxy := flag.String("proxy", "", "with -check, the proxy to check through")
+	configFile := flag.String("config", "", "read addr, timeout, allow, token, tls_cert, tls_key and max_concurrent from this JSON file; flags take precedence")
+	flag.Parse()
+
+	if *configFile != "" {
+		fc, err := loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := fc.apply(flag.CommandLine); err != nil {
+			log.Fatalf("config %s: %v", *configFile, err)
+		}
+	}
+
+	if len(addrs) == 0 {
+		_ = addrs.Set(envOr("LISTEN_ADDR", ":8080"))
+	}
+	if *timeout <= 0 {
+		log.Fatalf("invalid -timeout %v: must be positive", *timeout)
+	}
+	if *maxBatchTargets <= 0 {
+		log.Fatalf("invalid -max-batch-targets %d: must be positive", *maxBatchTargets)
+	}
+	if *maxConcurrent < 0 {
+		log.Fatalf("invalid -max-concurrent %d: must not be negative", *maxConcurrent)
+	}
+	if *canary != "" {
+		if _, _, err := parseTarget(*canary); err != nil {
+			log.Fatalf("invalid -canary %q: %v", *canary, err)
+		}
+	}
+	if _, ok := lookupMode(*defaultMode); !ok {
+		log.Fatalf("invalid -default-mode %q: see /modes for the modes", *defaultMode)
+	}
+	if *proxyDrainLimit <= 0 {
+		log.Fatalf("invalid -proxy-drain-limit %d: must be positive", *proxyDrainLimit)
+	}
+	if *proxyTimeout < 0 {
+		log.Fatalf("invalid -proxy-timeout %v: must not be negative", *proxyTimeout)
+	}
+	if *cacheTTL < 0 {
+		log.Fatalf("invalid -cache-ttl %v: must not be negative", *cacheTTL)
+	}
+	if *retryAfter < 0 {
+		log.Fatalf("invalid -retry-after %v: must not be negative", *retryAfter)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	if (*clientCert == "") != (*clientKey == "") {
+		log.Fatal("-client-cert and -client-key must be set together")
+	}
+
+	if _, err := parseAllowlist(allow); err != nil {
+		log.Fatalf("invalid -allow: %v", err)
+	}
+
+	opts := []Option{
+		WithToken(*token),
+		WithAllowlist(allow),
+		WithDenyPrivate(*denyPrivate),
+		WithMaxTimeout(*maxTimeout),
+		WithBatchWorkers(*batchWorkers),
+		WithMaxBatchTargets(*maxBatchTargets),
+		WithMaxConcurrent(*maxConcurrent),
+		WithRetryAfter(*retryAfter),
+		WithCanary(*canary),
+		WithCORSOrigins(corsOrigins),
+		WithPprof(*enablePprof),
+		WithProxyHeaders(strings.Split(*proxyHeaders, ",")),
+		WithProxyPool(*proxyPoolIdle),
+		WithProxyDrainLimit(*proxyDrainLimit),
+		WithProxyTimeout(*proxyTimeout),
+		WithCacheTTL(*cacheTTL),
+		WithDialKeepAlive(*dialKeepAlive),
+		WithFallbackDelay(*fallbackDelay),
+		WithCertWarning(*certWarning),
+		WithDefaultMode(*defaultMode),
+		WithUserAgent(*userAgent),
+		WithRequestHeaders(http.Header(header)),
+	}
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			log.Fatalf("invalid -client-cert: %v", err)
+		}
+		opts = append(opts, WithClientCertificate(cert))
+	}
+	switch *logFormat {
+	case "json":
+		opts = append(opts, WithLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil))))
+	case "text":
+	default:
+		log.Fatalf("invalid -log-format %q: must be text or json", *logFormat)
+	}
+	if *useEnvProxy {
+		opts = append(opts, WithProxyFunc(http.ProxyFromEnvironment))
+	}
+	if *checkAddr != "" {
+		os.Exit(runCheck(newConfig(opts), *timeout, *checkAddr, *checkProxy, os.Stdout))
+	}
+	tp, err := newTracerProvider(context.Background())
+	if err != nil {
+		log.Fatalf("tracing: %v", err)
+	}
+	if tp != nil {
+		opts = append(opts, WithTracerProvider(tp))
+	}
+	handler := Run(*timeout, opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var svrs []*http.Server
+	for _, addr := range addrs {
+		svrs = append(svrs, &http.Server{Addr: addr, Handler: handler})
+	}
+	err = serve(ctx, svrs, *tlsCert, *tlsKey, *grace)
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if tp != nil {
+		if err := tp.Shutdown(flushCtx); err != nil {
+			log.Printf("tracing: %v", err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve binds each of svrs to its address and runs them until ctx is done or
+// one of them fails, and then shuts them all down together, giving in-flight
+// requests up to grace to finish. Nothing is served unless every address can
+// be bound. It serves HTTPS when certFile and keyFile are set.
+func serve(ctx context.Context, svrs []*http.Server, certFile, keyFile string, grace time.Duration) error {
+	var ls []net.Listener
+	for _, svr := range svrs {
+		l, err := net.Listen("tcp", svr.Addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return err
+		}
+		ls = append(ls, l)
+	}
+
+	errc := make(chan error, len(svrs))
+	for i, svr := range svrs {
+		l := ls[i]
+		go func() {
+			if certFile != "" {
+				log.Println("listening with tls on", l.Addr())
+				errc <- svr.ServeTLS(l, certFile, keyFile)
+				return
+			}
+			log.Println("listening on", l.Addr())
+			errc <- svr.Serve(l)
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		log.Printf("shutting down, waiting up to %v for in-flight checks", grace)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	var wg sync.WaitGroup
+	shutdownErrs := make([]error, len(svrs))
+	for i, svr := range svrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownErrs[i] = svr.Shutdown(shutdownCtx)
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	for _, err := range shutdownErrs {
+		if err != nil {
+			return fmt.Errorf("shutdown: %v", err)
+		}
+	}
+	log.Println("shutdown complete")
+	return nil
+}
+
+// target describes a single check: the host and port to reach, the proxy to
+// tunnel through, if any, and how to check it.
+type target struct {
+	Host  string `json:"host"`
+	Port  string `json:"port"`
+	Proxy string `json:"proxy,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	// Proto is tcp, udp or unix. With unix, Host is the path of the socket
+	// and Port is empty.
+	Proto string `json:"proto,omitempty"`
+	// Probe sends a probe datagram with proto udp, a ping in the ws and wss
+	// modes and EHLO in smtp mode.
+	Probe bool `json:"probe,omitempty"`
+	// Path is the request path used by the http, https, ws and wss modes.
+	Path string `json:"path,omitempty"`
+	// Follow makes the http and https modes follow redirects.
+	Follow bool `json:"follow,omitempty"`
+	// Retries is how many more times a failed dial is attempted, up to
+	// maxRetries.
+	Retries int `json:"retries,omitempty"`
+	// Record is the record type looked up in dns mode.
+	Record string `json:"record,omitempty"`
+	// From is the local address to dial from.
+	From string `json:"from,omitempty"`
+	// Family restricts dials to ip4 or ip6 addresses; dual, or empty, uses
+	// either.
+	Family string `json:"family,omitempty"`
+	// TLS makes grpc mode connect over TLS.
+	TLS bool `json:"tls,omitempty"`
+	// ALPN lists, comma-separated, the protocols tls mode offers in the
+	// handshake, such as h2,http/1.1.
+	ALPN string `json:"alpn,omitempty"`
+	// RawError reports the errno behind a failure in the result.
+	RawError bool `json:"raw_error,omitempty"`
+	// ProxyHTTP2 asks the proxy for the tunnel over HTTP/2.
+	ProxyHTTP2 bool `json:"proxy_http2,omitempty"`
+	// ProxyProtocol, v1 or v2, sends a PROXY protocol header ahead of the
+	// check.
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+	// Resolver is the ip:port of the DNS server to resolve the host with,
+	// in place of the system resolver.
+	Resolver string `json:"resolver,omitempty"`
+	// AllIPs dials every address the host resolves to in tcp mode, and
+	// Require, any or all, says how many of them must connect for the check
+	// to be OK; any when empty.
+	AllIPs  bool   `json:"all_ips,omitempty"`
+	Require string `json:"require,omitempty"`
+	// DNSTimeout and ConnectTimeout, durations such as 500ms, give
+	// resolving the host and connecting to it budgets of their own in place
+	// of the check timeout.
+	DNSTimeout     string `json:"dns_timeout,omitempty"`
+	ConnectTimeout string `json:"connect_timeout,omitempty"`
+	// ReadTimeout, a duration such as 2s, fails a check with READ_TIMEOUT
+	// when the target sends nothing for that long while the mode awaits a
+	// reply.
+	ReadTimeout string `json:"read_timeout,omitempty"`
+	// Send is a payload, in hex, to write once connected in tcp mode, and
+	// Expect, also in hex, what the reply must start with.
+	Send   string `json:"send,omitempty"`
+	Expect string `json:"expect,omitempty"`
+}
+
+// String returns t as the host:port, or unix:path, it checks.
+func (t target) String() string {
+	if t.Proto == "unix" {
+		return "unix:" + t.Host
+	}
+	return net.JoinHostPort(t.Host, t.Port)
+}
+
+// maxRetries caps the retries a single check may ask for, and retryBackoff is
+// the wait before the first retry, doubled before each one after it.
+const (
+	maxRetries   = 5
+	retryBackoff = 50 * time.Millisecond
+)
+
+// queryTarget reads the check options of a target from the query string of
+// r. The host and port come from the path and are left for the caller.
+func queryTarget(r *http.Request) target {
+	q := r.URL.Query()
+	probe, _ := strconv.ParseBool(q.Get("probe"))
+	tls, _ := strconv.ParseBool(q.Get("tls"))
+	proxyHTTP2, _ := strconv.ParseBool(q.Get("proxy-http2"))
+	follow, _ := strconv.ParseBool(q.Get("follow"))
+	allIPs, _ := strconv.ParseBool(q.Get("all-ips"))
+	rawError, _ := strconv.ParseBool(q.Get("raw-error"))
+	retries := 0
+	if v := q.Get("retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			n = -1
+		}
+		retries = n
+	}
+	return target{
+		Proxy:   q.Get("proxy"),
+		Mode:    q.Get("mode"),
+		Proto:   q.Get("proto"),
+		Probe:   probe,
+		Path:    q.Get("path"),
+		Follow:  follow,
+		Retries: retries,
+		Record:  q.Get("record"),
+		From:    q.Get("from"),
+		Family:  q.Get("family"),
+		TLS:     tls,
+		ALPN:    q.Get("alpn"),
+
+		RawError: rawError,
+
+		Resolver:      q.Get("resolver"),
+		ProxyHTTP2:    proxyHTTP2,
+		ProxyProtocol: q.Get("proxy-protocol"),
+		Send:          q.Get("send"),
+		Expect:        q.Get("expect"),
+
+		DNSTimeout:     q.Get("dns-timeout"),
+		ConnectTimeout: q.Get("connect-timeout"),
+		ReadTimeout:    q.Get("read-timeout"),
+
+		AllIPs:  allIPs,
+		Require: q.Get("require"),
+	}
+}
+
+// validate reports why t cannot be checked, as a result status and an error
+// describing the problem.
+func (t target) validate() (string, error) {
+	if t.Mode != "" {
+		m, ok := lookupMode(t.Mode)
+		if !ok {
+			return "INVALID_MODE", fmt.Errorf("unknown mode %q", t.Mode)
+		}
+		if !m.Proxy && t.Proxy != "" {
+			return "INVALID_MODE", fmt.Errorf("mode %q is not supported through a proxy", t.Mode)
+		}
+		if t.Mode != "tcp" && t.Proxy != "" {
+			if t.ProxyHTTP2 {
+				return "INVALID_MODE", fmt.Errorf("mode %q cannot be checked through a proxy-http2 tunnel", t.Mode)
+			}
+			if len(splitProxies(t.Proxy)) > 1 {
+				return "INVALID_MODE", fmt.Errorf("mode %q cannot be checked through a proxy fallback chain", t.Mode)
+			}
+		}
+	}
+	if t.Path != "" && !strings.HasPrefix(t.Path, "/") {
+		return "INVALID_PATH", fmt.Errorf("path %q must start with /", t.Path)
+	}
+	if t.ProxyHTTP2 && t.Proxy == "" {
+		return "INVALID_PROXY", errors.New("proxy-http2 needs a proxy")
+	}
+	if t.Follow && t.Mode != "http" && t.Mode != "https" {
+		return "INVALID_MODE", errors.New(`follow can only be used with mode "http" or "https"`)
+	}
+	if t.TLS && t.Mode != "grpc" {
+		return "INVALID_MODE", errors.New(`tls can only be used with mode "grpc"; use mode "tls" to check a TLS handshake`)
+	}
+	if t.ALPN != "" {
+		if t.Mode != "tls" {
+			return "INVALID_ALPN", errors.New(`alpn can only be used with mode "tls"`)
+		}
+		for _, proto := range strings.Split(t.ALPN, ",") {
+			if proto == "" || len(proto) > 255 {
+				return "INVALID_ALPN", fmt.Errorf("alpn protocol %q must be 1 to 255 bytes long", proto)
+			}
+		}
+	}
+	if t.Record != "" {
+		if t.Mode != "dns" {
+			return "INVALID_RECORD", errors.New(`record can only be used with mode "dns"`)
+		}
+		if _, ok := dnsRecords[t.Record]; !ok {
+			return "INVALID_RECORD", fmt.Errorf("unknown record type %q", t.Record)
+		}
+	}
+	if t.From != "" {
+		if net.ParseIP(t.From) == nil {
+			return "INVALID_SOURCE_ADDR", fmt.Errorf("from %q is not an IP address", t.From)
+		}
+		if t.Proxy != "" {
+			return "INVALID_SOURCE_ADDR", errors.New("from is not supported through a proxy")
+		}
+	}
+	switch t.ProxyProtocol {
+	case "":
+	case "v1", "v2":
+		if t.Proxy != "" {
+			return "INVALID_PROXY_PROTOCOL", errors.New("proxy-protocol is not supported through a proxy")
+		}
+		if t.Proto == "udp" {
+			return "INVALID_PROXY_PROTOCOL", errors.New("proxy-protocol is only supported over tcp")
+		}
+	default:
+		return "INVALID_PROXY_PROTOCOL", fmt.Errorf("unknown proxy-protocol %q; use v1 or v2", t.ProxyProtocol)
+	}
+	if t.Resolver != "" {
+		host, _, err := net.SplitHostPort(t.Resolver)
+		if err == nil && net.ParseIP(host) == nil {
+			err = fmt.Errorf("%q is not an IP address", host)
+		}
+		if err != nil {
+			return "INVALID_RESOLVER", fmt.Errorf("resolver must be ip:port: %v", err)
+		}
+		if t.Proxy != "" {
+			return "INVALID_RESOLVER", errors.New("resolver is not supported through a proxy, which resolves the target itself")
+		}
+	}
+	switch t.Family {
+	case "", "dual", "ip4", "ip6":
+	default:
+		return "INVALID_FAMILY", fmt.Errorf("unknown family %q; use ip4, ip6 or dual", t.Family)
+	}
+	if t.Retries < 0 || t.Retries > maxRetries {
+		return "INVALID_RETRIES", fmt.Errorf("retries must be a number from 0 to %d", maxRetries)
+	}
+	for name, v := range map[string]string{"dns-timeout": t.DNSTimeout, "connect-timeout": t.ConnectTimeout} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return "INVALID_TIMEOUT", fmt.Errorf("%s %q must be a positive duration such as 500ms", name, v)
+		}
+		if t.Proxy != "" {
+			return "INVALID_TIMEOUT", fmt.Errorf("%s is not supported through a proxy, which resolves and connects to the target itself", name)
+		}
+	}
+	if t.ReadTimeout != "" {
+		if d, err := time.ParseDuration(t.ReadTimeout); err != nil || d <= 0 {
+			return "INVALID_TIMEOUT", fmt.Errorf("read-timeout %q must be a positive duration such as 2s", t.ReadTimeout)
+		}
+	}
+	switch t.Require {
+	case "", "any", "all":
+	default:
+		return "INVALID_ALL_IPS", fmt.Errorf("unknown require %q; use any or all", t.Require)
+	}
+	if t.Require != "" && !t.AllIPs {
+		return "INVALID_ALL_IPS", errors.New("require can only be used with all-ips")
+	}
+	if t.AllIPs {
+		if (t.Mode != "" && t.Mode != "tcp") || (t.Proto != "" && t.Proto != "tcp") {
+			return "INVALID_ALL_IPS", errors.New(`all-ips can only be used with mode "tcp" over tcp`)
+		}
+		if t.Proxy != "" {
+			return "INVALID_ALL_IPS", errors.New("all-ips is not supported through a proxy, which resolves the target itself")
+		}
+		if t.Send != "" || t.Expect != "" {
+			return "INVALID_ALL_IPS", errors.New("all-ips cannot be used with send or expect")
+		}
+	}
+	if t.Send != "" || t.Expect != "" {
+		if _, err := decodePayload("send", t.Send); err != nil {
+			return "INVALID_PAYLOAD", err
+		}
+		if _, err := decodePayload("expect", t.Expect); err != nil {
+			return "INVALID_PAYLOAD", err
+		}
+		if (t.Mode != "" && t.Mode != "tcp") || t.Proto == "udp" {
+			return "INVALID_PAYLOAD", errors.New(`send and expect can only be used with mode "tcp" over tcp or a unix socket`)
+		}
+		if t.Proxy != "" {
+			return "INVALID_PAYLOAD", errors.New("send and expect are not supported through a proxy")
+		}
+		if t.Retries > 0 {
+			return "INVALID_PAYLOAD", errors.New("send and expect cannot be used with retries")
+		}
+	}
+
+	switch t.Proto {
+	case "", "tcp":
+	case "udp", "unix":
+		if t.Proxy != "" {
+			return "INVALID_PROTO", fmt.Errorf("proto %q is not supported through a proxy", t.Proto)
+		}
+		if t.Mode != "" && t.Mode != "tcp" {
+			return "INVALID_PROTO", fmt.Errorf("proto %q cannot be used with mode %q", t.Proto, t.Mode)
+		}
+		if t.Proto != "unix" {
+			break
+		}
+		if t.Port != "" {
+			return "INVALID_PROTO", errors.New("proto \"unix\" takes a socket path, as in /unix:/var/run/app.sock, not a port")
+		}
+		if t.From != "" || t.Resolver != "" || t.ProxyProtocol != "" || (t.Family != "" && t.Family != "dual") || t.DNSTimeout != "" {
+			return "INVALID_PROTO", errors.New("from, resolver, proxy-protocol, family and dns-timeout do not apply to unix sockets")
+		}
+	default:
+		return "INVALID_PROTO", fmt.Errorf("unknown proto %q", t.Proto)
+	}
+	return "", nil
+}
+
+// checkTarget checks t directly, or through its proxy when one is set, and
+// returns the HTTP status code and result to report for it. Dials and
+// handshakes are traced as children of the span in ctx, if any. While an
+// identical check is running its result is shared instead, as is, with a
+// cache configured, a recent one's.
+func checkTarget(ctx context.Context, cfg config, timeout time.Duration, t target) (int, result) {
+	t = cfg.withDefaultMode(t)
+	code, res := deniedAtDial(cfg.cache.do(ctx, cacheKey(t, timeout), func() (int, result) {
+		return checkTargetNow(ctx, cfg, timeout, t)
+	}))
+	res.Target = t.String()
+	if t.RawError {
+		res.Errno = errno(res.err)
+	}
+	return code, res
+}
+
+// errno returns the number of the syscall.Errno err wraps, as a failed dial's
+// *os.SyscallError does, or 0 when it wraps none.
+func errno(err error) int {
+	var n syscall.Errno
+	if errors.As(err, &n) {
+		return int(n)
+	}
+	return 0
+}
+
+// checkTargetNow is checkTarget without the cache.
+func checkTargetNow(ctx context.Context, cfg config, timeout time.Duration, t target) (int, result) {
+	if err := t.checkAddress(); err != nil {
+		return http.StatusBadRequest, result{
+			Status: "INVALID_HOST",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			Proxy:  t.Proxy,
+		}
+	}
+	if status, err := t.validate(); err != nil {
+		return http.StatusBadRequest, result{
+			Status: status,
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			Proxy:  t.Proxy,
+		}
+	}
+	if t.Proto == "unix" && (cfg.allow != nil || cfg.denyPrivate) {
+		err := errors.New("unix socket targets cannot be checked with an allowlist or deny-private in force")
+		return http.StatusForbidden, result{
+			Status: "TARGET_DENIED",
+			Error:  err.Error(),
+		}
+	}
+	if t.Resolver != "" && (cfg.allow != nil || cfg.denyPrivate) {
+		// the screen resolves with the system resolver, so a resolver of
+		// the caller's choosing could answer the dial with any address, and
+		// is itself an address the screen never sees
+		err := errors.New("resolver cannot be used with an allowlist or deny-private in force")
+		return http.StatusForbidden, result{
+			Status: "TARGET_DENIED",
+			Error:  err.Error(),
+		}
+	}
+	if status, err := cfg.screen(t.Host, t.Proxy, timeout); err != nil {
+		return http.StatusForbidden, result{
+			Status: status,
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			Proxy:  t.Proxy,
+		}
+	}
+	if t.Proxy == "" && t.Resolver == "" && t.ProxyProtocol == "" && (t.Mode == "" || t.Mode == "tcp") && (t.Proto == "" || t.Proto == "tcp") {
+		if proxy, err := cfg.envProxy(t.Host, t.Port); err != nil {
+			return http.StatusBadRequest, result{
+				Status: "PROXY_UNREACHABLE",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+			}
+		} else if proxy != nil {
+			if status, err := cfg.screen(t.Host, proxy.String(), timeout); err != nil {
+				return http.StatusForbidden, result{
+					Status: status,
+					Error:  err.Error(),
+					Code:   errorCode(err),
+					Proxy:  proxy.Redacted(),
+				}
+			}
+			code, res := cfg.proxy(timeout).check(ctx, proxy.String(), t.Host, t.Port)
+			res.Proxy = proxy.Redacted()
+			return code, res
+		}
+	}
+	if t.Proxy != "" {
+		p := cfg.proxy(timeout)
+		p.HTTP2 = t.ProxyHTTP2
+		if t.Mode != "" && t.Mode != "tcp" {
+			d := plainTest{
+				Dialer:      cfg.dialer(timeout),
+				ReadTimeout: phaseTimeout(t.ReadTimeout, cfg.maxTimeout),
+			}
+			return readTimedOut(p.through(ctx, checkers[t.Mode], t.Proxy, t.Host, t.Port, Options{Dialer: d, Target: t, cfg: cfg}))
+		}
+		return p.check(ctx, t.Proxy, t.Host, t.Port)
+	}
+	checker := plainTest{
+		Dialer:        cfg.dialer(timeout),
+		ProxyProtocol: t.ProxyProtocol,
+	}
+	if t.Resolver != "" {
+		checker.Resolver = newResolver(t.Resolver)
+	}
+	checker.DNSTimeout = phaseTimeout(t.DNSTimeout, cfg.maxTimeout)
+	checker.ConnectTimeout = phaseTimeout(t.ConnectTimeout, cfg.maxTimeout)
+	checker.ReadTimeout = phaseTimeout(t.ReadTimeout, cfg.maxTimeout)
+	switch {
+	case t.Proto == "unix":
+		checker.Network = "unix"
+	case t.Family == "ip4":
+		checker.Network = "tcp4"
+	case t.Family == "ip6":
+		checker.Network = "tcp6"
+	}
+	if ip := net.ParseIP(t.From); ip != nil {
+		if t.Proto == "udp" {
+			checker.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			checker.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	mode := t.Mode
+	if mode == "" {
+		mode = "tcp"
+	}
+	return readTimedOut(checkers[mode].Check(ctx, t.Host, t.Port, Options{Dialer: checker, Target: t, cfg: cfg}))
+}
+
+// checkTCP connects to host:port with checker.Check and closes the
+// connection again.
+func checkTCP(ctx context.Context, checker plainTest, host, port string) (int, result) {
+	d, err := checker.Check(ctx, host, port)
+	if err != nil {
+		code, status := http.StatusBadGateway, checker.phaseStatus(err)
+		switch status {
+		case "HOST_CONNECT_TIMEOUT", "DNS_TIMEOUT", "CONNECT_TIMEOUT":
+			code = http.StatusGatewayTimeout
+		case "INVALID_SOURCE_ADDR":
+			code = http.StatusBadRequest
+		}
+		return code, result{
+			Status:      status,
+			Error:       err.Error(),
+			Code:        errorCode(err),
+			Attempts:    d.Attempts,
+			ResolvedIPs: d.IPs,
+			err:         err,
+		}
+	}
+	return http.StatusOK, result{
+		Status:      "OK",
+		LatencyMS:   millis(d.Latency),
+		Attempts:    d.Attempts,
+		ResolvedIPs: d.IPs,
+		Family:      d.Family,
+		LocalAddr:   d.LocalAddr,
+		RemoteAddr:  d.RemoteAddr,
+	}
 }
 
 type plainTest struct {
 	net.Dialer
+	// Network is the network to dial, "tcp" when empty.
+	Network string
+	// Retries is how many more times Check dials after a transient failure.
+	Retries int
+	// ProxyProtocol, v1 or v2, sends a PROXY protocol header on every
+	// connection before anything else.
+	ProxyProtocol string
+	// DNSTimeout and ConnectTimeout, when set, bound resolving the host and
+	// dialing it in place of Timeout. A host name given to Connect is
+	// resolved as part of the dial.
+	DNSTimeout, ConnectTimeout time.Duration
+	// ReadTimeout, when set, fails each read on the connections Connect
+	// makes once no data has arrived for that long.
+	ReadTimeout time.Duration
+	// Tunnel, when set, opens the connections Connect makes, through a
+	// proxy, in place of dialing. It returns how long the proxy took to
+	// dial.
+	Tunnel func(ctx context.Context, host, port string) (net.Conn, time.Duration, error)
+}
+
+// dial describes how a Check went.
+type dial struct {
+	// Latency is how long the successful connection took to establish.
+	Latency time.Duration
+	// Attempts is the number of times the host was resolved and dialed.
+	Attempts int
+	// IPs are the addresses host resolved to, nil if resolution failed.
+	IPs []string
+	// Family is the address family, ip4 or ip6, of the connection made.
+	Family string
+	// LocalAddr and RemoteAddr are the two ends of the connection made.
+	LocalAddr, RemoteAddr string
+}
+
+// Check resolves host, dials its addresses on port as connectAny does and
+// reports how long the connection took to establish. On the unix network host is the
+// socket path and is dialed as it is. Failed attempts are retried with
+// exponential backoff, up to t.Retries times, unless the host does not exist.
+// Canceling ctx abandons the check.
+func (t plainTest) Check(ctx context.Context, host, port string) (dial, error) {
+	var d dial
+	backoff := retryBackoff
+	for {
+		d.Attempts++
+		var c net.Conn
+		var err error
+		if t.Network == "unix" {
+			c, d.Latency, err = t.Connect(ctx, host, port)
+		} else if d.IPs, err = t.Resolve(ctx, host); err == nil {
+			c, d.Latency, err = t.connectAny(ctx, d.IPs, port)
+		}
+		if err == nil {
+			d.LocalAddr, d.RemoteAddr = c.LocalAddr().String(), c.RemoteAddr().String()
+			if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+				d.Family = "ip6"
+				if addr.IP.To4() != nil {
+					d.Family = "ip4"
+				}
+			}
+			if t.ProxyProtocol != "" {
+				err = proxyProtocolAccepted(c)
+			}
+			c.Close()
+			if err == nil {
+				return d, nil
+			}
+		}
+		if d.Attempts > t.Retries || !retryable(err) || ctx.Err() != nil {
+			return d, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return d, err
+		}
+		backoff *= 2
+	}
 }
 
-func (t plainTest) Check(host, port string) error {
-	c, err := t.Dial("tcp", net.JoinHostPort(host, port))
+// lookup returns the resolver to use and a context bounding a lookup by the
+// dial timeout as well as by parent. The caller must call cancel once the
+// lookup is done.
+func (t plainTest) lookup(parent context.Context) (resolver *net.Resolver, ctx context.Context, cancel context.CancelFunc) {
+	resolver = t.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if t.DNSTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, t.DNSTimeout)
+		return resolver, ctx, cancel
+	}
+	if t.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, t.Timeout)
+		return resolver, ctx, cancel
+	}
+	ctx, cancel = context.WithCancel(parent)
+	return resolver, ctx, cancel
+}
+
+// errNoA and errNoAAAA report that a host has no address in the family the
+// network of a plainTest is restricted to.
+var (
+	errNoA    = errors.New("no A record")
+	errNoAAAA = errors.New("no AAAA record")
+)
+
+// Resolve looks up the addresses of host within the dial timeout, keeping only
+// those of the family t.Network is restricted to, if any.
+func (t plainTest) Resolve(ctx context.Context, host string) ([]string, error) {
+	resolver, ctx, cancel := t.lookup(ctx)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.Close()
-	return nil
+	var ips []string
+	for _, addr := range addrs {
+		is4 := addr.IP.To4() != nil
+		switch {
+		case strings.HasSuffix(t.Network, "4") && !is4:
+		case strings.HasSuffix(t.Network, "6") && is4:
+		default:
+			ips = append(ips, addr.String())
+		}
+	}
+	if len(ips) == 0 {
+		if strings.HasSuffix(t.Network, "6") {
+			return nil, fmt.Errorf("%s: %w", host, errNoAAAA)
+		}
+		return nil, fmt.Errorf("%s: %w", host, errNoA)
+	}
+	return ips, nil
+}
+
+// connectAny dials ips on port, all within one dial timeout, and returns the
+// first connection to succeed. The addresses of the family of the first are
+// dialed one after another, and those of the other family, one after another
+// too, are raced against them once t.FallbackDelay has passed or the first
+// family has failed, as net.Dialer does for a host name. A negative
+// FallbackDelay dials all of ips in turn.
+func (t plainTest) connectAny(ctx context.Context, ips []string, port string) (net.Conn, time.Duration, error) {
+	if t.ConnectTimeout > 0 {
+		t.Timeout = t.ConnectTimeout
+	}
+	if t.Timeout > 0 {
+		t.Deadline = time.Now().Add(t.Timeout)
+	}
+	primaries, fallbacks := splitFamilies(ips)
+	if t.FallbackDelay < 0 || len(fallbacks) == 0 {
+		return t.connectInTurn(ctx, ips, port)
+	}
+	delay := t.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type dialed struct {
+		c       net.Conn
+		latency time.Duration
+		err     error
+		primary bool
+	}
+	results := make(chan dialed)
+	returned := make(chan struct{})
+	defer close(returned)
+	race := func(ips []string, primary bool) {
+		c, latency, err := t.connectInTurn(ctx, ips, port)
+		select {
+		case results <- dialed{c, latency, err, primary}:
+		case <-returned:
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	go race(primaries, true)
+	fallback := time.NewTimer(delay)
+	defer fallback.Stop()
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-fallback.C:
+			go race(fallbacks, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.c, res.latency, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+				// the fallback need not wait any longer
+				if fallback.Stop() {
+					fallback.Reset(0)
+				}
+			} else {
+				fallbackErr = res.err
+			}
+			if primaryErr != nil && fallbackErr != nil {
+				return nil, 0, primaryErr
+			}
+		}
+	}
+}
+
+// defaultFallbackDelay is how long connectAny waits on the first family of
+// addresses before racing the other when no FallbackDelay is set, as
+// net.Dialer does.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// splitFamilies splits ips into those of the family of the first and those
+// of the other, keeping their order.
+func splitFamilies(ips []string) (primaries, fallbacks []string) {
+	for _, ip := range ips {
+		if strings.Contains(ip, ":") == strings.Contains(ips[0], ":") {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// connectInTurn dials ips on port one after another and returns the first
+// connection to succeed.
+func (t plainTest) connectInTurn(ctx context.Context, ips []string, port string) (net.Conn, time.Duration, error) {
+	var firstErr error
+	for _, ip := range ips {
+		c, latency, err := t.Connect(ctx, ip, port)
+		if err == nil {
+			return c, latency, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, 0, firstErr
+}
+
+// dialStatus classifies err from a failed Check as the result status to
+// report.
+func dialStatus(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errProxyProtocolRejected):
+		return "PROXY_PROTOCOL_REJECTED"
+	case errors.Is(err, errNoA):
+		return "NO_A_RECORD"
+	case errors.Is(err, errNoAAAA):
+		return "NO_AAAA_RECORD"
+	case errors.As(err, &dnsErr):
+		return "DNS_RESOLUTION_FAIL"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "HOST_CONNECT_TIMEOUT"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "HOST_REFUSED"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		// the from address could not be bound
+		return "INVALID_SOURCE_ADDR"
+	}
+	return "HOST_CONNECT_FAIL"
+}
+
+// phaseStatus classifies err as dialStatus does, but names the phase that
+// timed out, DNS_TIMEOUT or CONNECT_TIMEOUT, when t gave that phase a budget
+// of its own.
+func (t plainTest) phaseStatus(err error) string {
+	var dnsErr *net.DNSError
+	status := dialStatus(err)
+	switch {
+	case t.DNSTimeout > 0 && errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return "DNS_TIMEOUT"
+	case t.ConnectTimeout > 0 && status == "HOST_CONNECT_TIMEOUT":
+		return "CONNECT_TIMEOUT"
+	}
+	return status
+}
+
+// phaseTimeout parses the budget of a check phase, as validated, capping it at
+// max. It returns 0, leaving the phase to the check timeout, when v is empty.
+func phaseTimeout(v string, max time.Duration) time.Duration {
+	d, _ := time.ParseDuration(v)
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// retryable reports whether a dial that failed with err may succeed if tried
+// again. Timeouts and refused connections are; unknown hosts, source
+// addresses that cannot be bound and backends that hang up on a PROXY
+// protocol header are not.
+func retryable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	return !errors.Is(err, syscall.EADDRNOTAVAIL) && !errors.Is(err, errNoA) && !errors.Is(err, errNoAAAA) &&
+		!errors.Is(err, errProxyProtocolRejected)
+}
+
+// Connect dials host:port, or the socket path host on the unix network, and
+// returns the open connection along with how long it took to establish.
+// Canceling ctx aborts the dial.
+func (t plainTest) Connect(ctx context.Context, host, port string) (net.Conn, time.Duration, error) {
+	if t.Tunnel != nil {
+		c, latency, err := t.Tunnel(ctx, host, port)
+		return t.idle(c), latency, err
+	}
+	if t.ConnectTimeout > 0 {
+		t.Timeout = t.ConnectTimeout
+	}
+	network := t.Network
+	if network == "" {
+		network = "tcp"
+	}
+	addr := net.JoinHostPort(host, port)
+	if network == "unix" {
+		addr = host
+	}
+	_, s := startSpan(ctx, "dial", trace.SpanKindClient)
+	s.SetAttributes(attribute.String("network", network), attribute.String("address", addr))
+	defer s.End()
+	start := time.Now()
+	c, err := t.DialContext(ctx, network, addr)
+	if err != nil {
+		setSpanStatus(s, false, err.Error())
+		return nil, 0, err
+	}
+	latency := time.Since(start)
+	if t.ProxyProtocol != "" {
+		if err := sendProxyProtocol(c, t.ProxyProtocol); err != nil {
+			c.Close()
+			setSpanStatus(s, false, err.Error())
+			return nil, 0, err
+		}
+	}
+	setSpanStatus(s, true, "")
+	return t.idle(c), latency, nil
 }
 
 type proxyTest struct {
@@ -93,52 +1418,423 @@ type proxyTest struct {
 	ProxyURL url.URL
 }
 
+// parseProxy parses a proxy query value. A value without a scheme, such as
+// host:port or user:pass@host:port, is treated as an HTTP CONNECT proxy.
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+// envProxy returns the proxy cfg.proxyFunc picks for host:port, or nil when
+// there is none and the target should be checked directly.
+func (cfg config) envProxy(host, port string) (*url.URL, error) {
+	if cfg.proxyFunc == nil {
+		return nil, nil
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)},
+		Header: http.Header{},
+	}
+	return cfg.proxyFunc(req)
+}
+
 type proxyHandler struct {
 	// net.Dialer
 	Timeout time.Duration
+	// ProxyTimeout, when set and shorter than Timeout, bounds the dial to
+	// the proxy; the tunnel request still has Timeout.
+	ProxyTimeout time.Duration
+	// RootCAs verifies https:// proxies; nil means the system pool.
+	RootCAs *x509.CertPool
+	// Headers names the headers of the proxy's CONNECT response to report
+	// in the result.
+	Headers []string
+	// Pool, when set, supplies idle connections to http:// and https://
+	// proxies and takes back the ones still usable after a check.
+	Pool *proxyPool
+	// Drainer discards CONNECT response bodies; with none they are left
+	// unread.
+	Drainer *drainer
+	// DrainLimit caps how much of a CONNECT response body is read and
+	// discarded; defaultDrainLimit when 0.
+	DrainLimit int64
+	// HTTP2 asks http:// and https:// proxies for the tunnel over HTTP/2.
+	HTTP2 bool
+	// RequestHeader is added to the CONNECT requests sent to http:// and
+	// https:// proxies.
+	RequestHeader http.Header
+	// Control, when set, is the net.Dialer Control hook proxies are dialed
+	// with.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// defaultDrainLimit is how much of a CONNECT response body a proxyHandler
+// reads unless told otherwise.
+const defaultDrainLimit = 64 << 10
+
+// proxy returns a proxyHandler configured by cfg.
+func (cfg config) proxy(timeout time.Duration) proxyHandler {
+	return proxyHandler{
+		Timeout: timeout,
+		RootCAs: cfg.rootCAs,
+		Headers: cfg.proxyHeaders,
+		Pool:    cfg.proxyPool,
+
+		ProxyTimeout:  cfg.proxyTimeout,
+		Drainer:       cfg.drainer,
+		DrainLimit:    cfg.proxyDrain,
+		RequestHeader: cfg.requestHeader(),
+		Control:       cfg.dialer(timeout).Control,
+	}
+}
+
+// dialTimeout is how long p may take to dial a proxy.
+func (p proxyHandler) dialTimeout() time.Duration {
+	if p.ProxyTimeout > 0 && (p.Timeout <= 0 || p.ProxyTimeout < p.Timeout) {
+		return p.ProxyTimeout
+	}
+	return p.Timeout
 }
 
 func (p proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	proxy := r.URL.Query().Get("proxy")
-	host, port, err := net.SplitHostPort(r.URL.Path[1:])
+	host, port, err := parseTarget(r.URL.Path[1:])
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, result{
-			Status: "BAD_URL",
+			Status: "INVALID_HOST",
+			Target: r.URL.Path[1:],
 			Error:  err.Error(),
+			Code:   errorCode(err),
 			Proxy:  proxy,
 		})
 		return
 	}
-	dialer := net.Dialer{Timeout: p.Timeout, KeepAlive: 0}
-	c, err := dialer.Dial("tcp", proxy)
+	p.HTTP2 = queryTarget(r).ProxyHTTP2
+	// the proxy's reply headers describe the tunnel, not our JSON body, so
+	// none of them are passed on
+	code, reslt := p.check(r.Context(), proxy, host, port)
+	reslt.Target = net.JoinHostPort(host, port)
+	writeJSON(w, code, reslt)
+}
+
+// check opens a tunnel to host:port through proxy and returns the HTTP status
+// code and result to report. A comma separated list of proxies is a fallback
+// chain: each is tried in turn until one succeeds, and those that failed are
+// listed in ProxyAttempts. When all of them fail the check reports
+// PROXY_CONNECT_ERROR with the last error.
+func (p proxyHandler) check(ctx context.Context, proxy, host, port string) (int, result) {
+	proxies := splitProxies(proxy)
+	if len(proxies) < 2 {
+		res, err := p.connect(ctx, proxy, host, port)
+		if err, ok := err.(*proxyError); ok {
+			res.err = err.Err
+			return err.Code, res
+		}
+		return http.StatusOK, res
+	}
+	var attempts []proxyAttempt
+	var last result
+	code := http.StatusBadGateway
+	for _, proxy := range proxies {
+		res, err := p.connect(ctx, proxy, host, port)
+		if err == nil {
+			res.ProxyAttempts = attempts
+			return http.StatusOK, res
+		}
+		attempts = append(attempts, proxyAttempt{
+			Proxy:  proxy,
+			Status: res.Status,
+			Error:  res.Error,
+			Code:   res.Code,
+		})
+		last = res
+		last.Proxy = proxy
+		if err, ok := err.(*proxyError); ok {
+			code = err.Code
+			last.err = err.Err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return code, result{
+		Status:        "PROXY_CONNECT_ERROR",
+		Error:         last.Error,
+		Code:          last.Code,
+		Proxy:         last.Proxy,
+		ProxyAttempts: attempts,
+		err:           last.err,
+	}
+}
+
+// reasonPhrase returns the reason phrase of res, such as Forbidden for a
+// status of "403 Forbidden".
+func reasonPhrase(res *http.Response) string {
+	return strings.TrimSpace(strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode)))
+}
+
+// proxyAttempt records a proxy of a fallback chain that failed.
+type proxyAttempt struct {
+	Proxy  string `json:"proxy"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// splitProxies splits a comma separated ?proxy= value into its proxies.
+func splitProxies(proxy string) []string {
+	var proxies []string
+	for _, p := range strings.Split(proxy, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+// proxyError is returned by connect when a proxy check fails. Code is the
+// HTTP status the check is answered with.
+type proxyError struct {
+	Code int
+	Err  error
+}
+
+func (e *proxyError) Error() string { return e.Err.Error() }
+func (e *proxyError) Unwrap() error { return e.Err }
+
+// connectViaProxy opens a tunnel to host:port through proxy within timeout,
+// verifying https:// proxies against the system pool. It is connect without
+// the options of a configured proxyHandler.
+func connectViaProxy(ctx context.Context, proxy, host, port string, timeout time.Duration) (result, error) {
+	return proxyHandler{Timeout: timeout}.connect(ctx, proxy, host, port)
+}
+
+// connect dials proxy, asks it for a tunnel to host:port and parses its
+// answer. The result describes the outcome either way; the error, a
+// *proxyError, is set when the check failed. The dial, handshake and tunnel
+// request are traced as children of the span in ctx, if any.
+func (p proxyHandler) connect(ctx context.Context, proxy, host, port string) (result, error) {
+	_, res, err := p.open(ctx, proxy, host, port, false)
+	return res, err
+}
+
+// open is connect, also returning the tunnel, left open, when hold is set and
+// the check succeeded. HTTP/2 tunnels cannot be held.
+func (p proxyHandler) open(ctx context.Context, proxy, host, port string, hold bool) (net.Conn, result, error) {
+	proxyURL, err := parseProxy(proxy)
+	if err == nil {
+		switch proxyURL.Scheme {
+		case "http", "https", "socks4", "socks4a", "socks5":
+			_, _, err = net.SplitHostPort(proxyURL.Host)
+		default:
+			err = fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+	}
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, result{
-			Status: "PROXY_UNREACHABLE",
+		err = fmt.Errorf("proxy must be host:port or a URL: %v", err)
+		return nil, result{
+			Status: "INVALID_PROXY",
 			Error:  err.Error(),
+			Code:   errorCode(err),
 			Proxy:  proxy,
-		})
-		return
+		}, &proxyError{http.StatusBadRequest, err}
+	}
+	if strings.EqualFold(proxyURL.Hostname(), host) && proxyURL.Port() == port {
+		err := errors.New("the proxy is the target itself; put the target in the path and the proxy in ?proxy=")
+		return nil, result{
+			Status: "PROXY_EQUALS_TARGET",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			Proxy:  proxy,
+		}, &proxyError{http.StatusBadRequest, err}
 	}
-	defer c.Close()
+	if p.HTTP2 {
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+			err := fmt.Errorf("proxy-http2 needs an http:// or https:// proxy, not %s://", proxyURL.Scheme)
+			return nil, result{
+				Status: "INVALID_PROXY",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+				Proxy:  proxy,
+			}, &proxyError{http.StatusBadRequest, err}
+		}
+		res, err := p.connectHTTP2(ctx, proxy, proxyURL, host, port)
+		return nil, res, err
+	}
+	poolKey := proxyURL.Scheme + "://" + proxyURL.Host
+	pooled := proxyURL.Scheme == "http" || proxyURL.Scheme == "https"
+	var c net.Conn
+	var br *bufio.Reader
+	if pooled {
+		c, br = p.Pool.get(poolKey)
+	}
+	reused := c != nil
+	var latency time.Duration
+	start := time.Now()
+	if !reused {
+		dialer := net.Dialer{Timeout: p.dialTimeout(), KeepAlive: 0, Control: p.Control}
+		_, s := startSpan(ctx, "proxy dial", trace.SpanKindClient)
+		s.SetAttributes(attribute.String("address", proxyURL.Host))
+		c, err = dialer.DialContext(ctx, "tcp", proxyURL.Host)
+		if err != nil {
+			setSpanStatus(s, false, err.Error())
+			s.End()
+			if res, err := requestCanceled(ctx, proxy); err != nil {
+				return nil, res, err
+			}
+			return nil, result{
+				Status: "PROXY_UNREACHABLE",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+				Proxy:  proxy,
+			}, &proxyError{http.StatusBadRequest, err}
+		}
+		latency = time.Since(start)
+		setSpanStatus(s, true, "")
+		s.End()
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			c.Close()
+		}
+	}()
 	if p.Timeout > 0 {
 		_ = c.SetDeadline(time.Now().Add(p.Timeout))
 	}
+	// the handshakes and the CONNECT response are read with deadlines, not
+	// ctx, so ctx ending, as when the client goes away, cuts them short by
+	// moving the deadline up
+	raw := c
+	stop := context.AfterFunc(ctx, func() { _ = raw.SetDeadline(time.Now()) })
+	defer stop()
 
-	fmt.Fprintf(c, "CONNECT %s:%s HTTP/1.1\n\n", host, port)
-	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	start = time.Now()
+
+	if proxyURL.Scheme == "https" && !reused {
+		tc := tls.Client(c, &tls.Config{
+			ServerName: proxyURL.Hostname(),
+			RootCAs:    p.RootCAs,
+		})
+		_, s := startSpan(ctx, "proxy tls handshake", trace.SpanKindClient)
+		err := tc.Handshake()
+		setSpanStatus(s, err == nil, fmt.Sprint(err))
+		s.End()
+		if err != nil {
+			if res, err := requestCanceled(ctx, proxy); err != nil {
+				return nil, res, err
+			}
+			return nil, result{
+				Status:    "PROXY_TLS_FAIL",
+				Error:     err.Error(),
+				Code:      errorCode(err),
+				Proxy:     proxy,
+				LatencyMS: millis(latency),
+			}, &proxyError{http.StatusBadGateway, err}
+		}
+		c = tc
+	}
+	if br == nil {
+		br = bufio.NewReader(c)
+	}
+
+	_, s := startSpan(ctx, "proxy connect", trace.SpanKindClient)
+	s.SetAttributes(
+		attribute.String("scheme", proxyURL.Scheme),
+		attribute.String("target", net.JoinHostPort(host, port)),
+	)
+	defer s.End()
+
+	if scheme := proxyURL.Scheme; scheme != "http" && scheme != "https" {
+		if scheme == "socks5" {
+			err = socks5Connect(c, host, port)
+		} else {
+			// a host name is resolved within the check timeout, as the
+			// handshake is
+			var lookupCtx context.Context
+			var cancel context.CancelFunc
+			if p.Timeout > 0 {
+				lookupCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+			} else {
+				lookupCtx, cancel = context.WithCancel(ctx)
+			}
+			err = socks4Connect(lookupCtx, c, host, port, proxyURL.User.Username(), scheme == "socks4a")
+			cancel()
+		}
+		if err != nil {
+			if res, err := requestCanceled(ctx, proxy); err != nil {
+				setSpanStatus(s, false, res.Error)
+				return nil, res, err
+			}
+			status := http.StatusBadGateway
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				status = http.StatusGatewayTimeout
+			}
+			setSpanStatus(s, false, err.Error())
+			return nil, result{
+				Status: "PROXY_CONNECT_ERROR",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+				Proxy:  proxy,
+			}, &proxyError{status, err}
+		}
+		setSpanStatus(s, true, "")
+		keep = hold
+		return held(c, nil, hold), result{
+			Status:    "OK",
+			Proxy:     proxy,
+			LatencyMS: millis(latency),
+			ConnectMS: millis(time.Since(start)),
+		}, nil
+	}
+
+	target := net.JoinHostPort(host, port)
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		fmt.Fprintf(c, "Proxy-Authorization: Basic %s\r\n", cred)
+	}
+	_ = p.RequestHeader.Write(c)
+	fmt.Fprint(c, "\r\n")
+	if p.Timeout > 0 {
+		// the response gets a full timeout of its own, however long the
+		// dial and handshake took, so a proxy that stalls mid-response is
+		// cut off rather than holding the check
+		_ = c.SetReadDeadline(time.Now().Add(p.Timeout))
+	}
+	// ReadResponse reports a connection closed before the status line as
+	// io.ErrUnexpectedEOF, as it does one closed partway through it, so
+	// peeking first tells a proxy that never answered from one that broke
+	// off its answer
+	var res *http.Response
+	_, err = br.Peek(1)
+	if err == nil {
+		res, err = http.ReadResponse(br, nil)
+	}
 
 	reslt := result{
-		Status: "OK",
-		Proxy:  proxy,
+		Status:      "OK",
+		Proxy:       proxy,
+		LatencyMS:   millis(latency),
+		ConnectMS:   millis(time.Since(start)),
+		ProxyReused: reused,
 	}
 	if err != nil {
-		log.Println(err, "host", host, "port", port, "proxy", proxy)
-
+		if res, err := requestCanceled(ctx, proxy); err != nil {
+			setSpanStatus(s, false, res.Error)
+			res.LatencyMS, res.ConnectMS, res.ProxyReused = reslt.LatencyMS, reslt.ConnectMS, reused
+			return nil, res, err
+		}
 		var status int
 		// status = http.StatusInternalServerError
 		status = http.StatusGatewayTimeout
 		reslt.Status = "PROXY_CONNECT_ERROR"
 		reslt.Error = err.Error()
+		reslt.Code = errorCode(err)
 
 		switch err := err.(type) {
 		case net.Error:
@@ -148,26 +1844,93 @@ func (p proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				if err.Timeout() {
 					status = http.StatusGatewayTimeout
 					reslt.Status = "PROXY_CONNECT_ERROR"
-					log.Println(err)
 				}
 				reslt.Error = fmt.Errorf("net error: %v", err).Error()
 			}
 		default:
+			status = http.StatusBadGateway
+			if err == io.EOF {
+				// the proxy accepted the connection and closed it without
+				// a word, as an overloaded one will
+				reslt.Status = "PROXY_CLOSED_CONNECTION"
+				reslt.Error = "proxy closed the connection without answering CONNECT"
+			} else {
+				// the proxy answered, but not with an HTTP response: a
+				// malformed or truncated status line or headers
+				reslt.Status = "PROXY_BAD_RESPONSE"
+			}
 		}
 
-		writeJSON(w, status, reslt)
-		return
+		setSpanStatus(s, false, reslt.Error)
+		return nil, reslt, &proxyError{status, err}
 	}
-	go func() {
-		io.Copy(ioutil.Discard, res.Body)
+	if p.Pool != nil && (res.StatusCode < 200 || res.StatusCode > 299) && !res.Close && stop() {
+		// the proxy refused the tunnel but is still speaking HTTP, so once
+		// the body is read the connection can carry another CONNECT
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxPooledBody+1))
 		res.Body.Close()
-	}()
+		if err == nil && n <= maxPooledBody {
+			_ = c.SetDeadline(time.Time{})
+			p.Pool.put(poolKey, c, br)
+			keep = true
+		}
+	} else if !hold || res.StatusCode < 200 || res.StatusCode > 299 {
+		// the body is discarded in the background so the check need not wait
+		// for it; the limit and the connection deadline stop a proxy that
+		// keeps sending from holding the goroutine forever
+		limit := p.DrainLimit
+		if limit <= 0 {
+			limit = defaultDrainLimit
+		}
+		p.Drainer.drain(res.Body, limit)
+	}
 
-	for k, vals := range res.Header {
-		for _, v := range vals {
-			w.Header().Set(k, v)
+	for _, name := range p.Headers {
+		if values := res.Header.Values(name); len(values) > 0 {
+			if reslt.ProxyHeaders == nil {
+				reslt.ProxyHeaders = map[string]string{}
+			}
+			reslt.ProxyHeaders[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
 		}
-		w.Header().Del("content-length")
 	}
-	writeJSON(w, res.StatusCode, reslt)
-}
\ No newline at end of file
+
+	s.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		reslt.ProxyStatusText = reasonPhrase(res)
+	}
+	switch {
+	case res.StatusCode == http.StatusProxyAuthRequired:
+		reslt.Status = "PROXY_AUTH_REQUIRED"
+		reslt.Error = res.Status
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		reslt.Status = "PROXY_REFUSED"
+		reslt.Error = fmt.Sprintf("proxy answered CONNECT with %d", res.StatusCode)
+	default:
+		setSpanStatus(s, true, "")
+		keep = hold
+		return held(c, br, hold), reslt, nil
+	}
+	setSpanStatus(s, false, reslt.Error)
+	return nil, reslt, &proxyError{res.StatusCode, errors.New(reslt.Error)}
+}
+
+// statusClientClosedRequest is the status, after nginx's, of a check cut
+// short because its request was canceled. The client has gone and never sees
+// it; the access log and metrics do.
+const statusClientClosedRequest = 499
+
+// requestCanceled returns the REQUEST_CANCELED result of a proxy check cut
+// short by ctx being canceled, as it is when the client goes away, or a nil
+// error when ctx was not canceled and the failure is the proxy's.
+func requestCanceled(ctx context.Context, proxy string) (result, *proxyError) {
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		return result{}, nil
+	}
+	err := fmt.Errorf("request canceled while waiting on the proxy: %w", ctx.Err())
+	return result{
+		Status: "REQUEST_CANCELED",
+		Error:  err.Error(),
+		Code:   errorCode(err),
+		Proxy:  proxy,
+	}, &proxyError{statusClientClosedRequest, err}
+}
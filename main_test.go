@@ -3,16 +3,30 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"syscall"
 	"testing"
 	"time"
 
@@ -26,10 +40,15 @@ func init() {
 func TestServer(t *testing.T) {
 	log.SetFlags(log.Lshortfile)
 	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
 	proxyAddr := proxy.Addr().String()
 	{
 		go func() {
-			c, _ := proxy.Accept()
+			c, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
 			c.SetDeadline(time.Now().Add(time.Second))
 			req, _ := http.ReadRequest(bufio.NewReader(c))
 			if http.MethodConnect != req.Method {
@@ -39,7 +58,8 @@ func TestServer(t *testing.T) {
 					line,
 					http.MethodConnect,
 					req.Method)
-				t.FailNow()
+				t.Fail()
+				return
 			}
 			t.Log(req.Method)
 			var buf bytes.Buffer
@@ -65,7 +85,25 @@ func TestServer(t *testing.T) {
 			StatusRange(httpexpect.Status2xx).
 			JSON().Object().
 			ValueEqual("status", "OK").
-			NotContainsKey("proxy")
+			NotContainsKey("proxy").
+			Value("latency_ms").Number().Ge(0)
+	})
+
+	t.Run("health check", func(t *testing.T) {
+		e.GET("/healthz").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "UP")
+	})
+
+	t.Run("missing target", func(t *testing.T) {
+		e.GET("/").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "MISSING_TARGET").
+			NotContainsKey("target")
 	})
 
 	t.Run("invalid host", func(t *testing.T) {
@@ -73,7 +111,8 @@ func TestServer(t *testing.T) {
 			Expect().
 			StatusRange(httpexpect.Status4xx).
 			JSON().Object().
-			ValueEqual("status", "INVALID_HOST")
+			ValueEqual("status", "INVALID_HOST").
+			ValueEqual("target", "xyz")
 	})
 
 	t.Run("unreachable host", func(t *testing.T) {
@@ -84,12 +123,79 @@ func TestServer(t *testing.T) {
 			ValueEqual("status", "INVALID_HOST")
 	})
 
-	t.Run("host unreachable", func(t *testing.T) {
+	for _, target := range []string{":80", "127.0.0.1:0", "127.0.0.1:99999",
+		string(bytes.Repeat([]byte("a"), 10<<10)) + ":80"} {
+		t.Run("invalid target "+target, func(t *testing.T) {
+			e.GET("/"+target).
+				Expect().
+				Status(http.StatusBadRequest).
+				JSON().Object().
+				ValueEqual("status", "INVALID_HOST")
+			e.GET("/"+target).
+				WithQuery("proxy", "127.0.0.1:3128").
+				Expect().
+				Status(http.StatusBadRequest).
+				JSON().Object().
+				ValueEqual("status", "INVALID_HOST")
+		})
+	}
+
+	// httpexpect would escape the % again, so these go out as written
+	for _, path := range []string{"/127.0.0.1%0A:80", "/unix:/tmp/app%0A.sock", "/127.0.0.1%09:80"} {
+		t.Run("control character "+path, func(t *testing.T) {
+			for _, query := range []string{"", "?proxy=127.0.0.1:3128"} {
+				code, res := getRawPath(t, svr.URL, path+query)
+				if code != http.StatusBadRequest || res.Status != "INVALID_HOST" {
+					t.Errorf("%s%s: expected 400 INVALID_HOST, got %d %s", path, query, code, res.Status)
+				}
+			}
+		})
+	}
+
+	t.Run("host refused", func(t *testing.T) {
 		e.GET("/127.0.0.1:1").
 			Expect().
 			StatusRange(httpexpect.Status5xx).
 			JSON().Object().
-			ValueEqual("status", "HOST_CONNECT_FAIL")
+			ValueEqual("status", "HOST_REFUSED")
+	})
+
+	for _, tc := range []struct{ path, target string }{
+		{"/127.0.0.1%3A1", "127.0.0.1:1"},
+		{"/%5B%3A%3A1%5D%3A1", "[::1]:1"},
+	} {
+		t.Run("percent-encoded "+tc.path, func(t *testing.T) {
+			code, res := getRawPath(t, svr.URL, tc.path)
+			if code < 500 || res.Status != "HOST_REFUSED" || res.Target != tc.target {
+				t.Errorf("expected 5xx HOST_REFUSED for %s, got %d %s %s", tc.target, code, res.Status, res.Target)
+			}
+		})
+	}
+
+	t.Run("doubly percent-encoded", func(t *testing.T) {
+		// the path is decoded once, leaving %3A in the host
+		code, res := getRawPath(t, svr.URL, "/127.0.0.1%253A1")
+		if code != http.StatusBadRequest || res.Status != "INVALID_HOST" || res.Target != "127.0.0.1%3A1" {
+			t.Errorf("expected 400 INVALID_HOST for 127.0.0.1%%3A1, got %d %s %s", code, res.Status, res.Target)
+		}
+	})
+
+	t.Run("invalid timeout", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("timeout", "soon").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_TIMEOUT")
+	})
+
+	t.Run("timeout override", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("timeout", "1s").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
 	})
 
 	t.Run("bad proxy", func(t *testing.T) {
@@ -99,8 +205,8 @@ func TestServer(t *testing.T) {
 			StatusRange(httpexpect.Status4xx).
 			JSON().Object().
 			ContainsMap(map[string]interface{}{
-				"error":  "dial tcp: address abc: missing port in address",
-				"status": "PROXY_UNREACHABLE",
+				"error":  "proxy must be host:port or a URL: address abc: missing port in address",
+				"status": "INVALID_PROXY",
 				"proxy":  "abc",
 			})
 	})
@@ -114,7 +220,9 @@ func TestServer(t *testing.T) {
 			ContainsMap(map[string]interface{}{
 				"status": "OK",
 				"proxy":  proxyAddr,
-			})
+			}).
+			ContainsKey("latency_ms").
+			ContainsKey("connect_ms")
 	})
 
 	t.Run("proxy times out", func(t *testing.T) {
@@ -162,7 +270,8 @@ func TestProxy(t *testing.T) {
 				line,
 				http.MethodConnect,
 				req.Method)
-			t.FailNow()
+			t.Fail()
+			return
 		}
 		t.Log(req.Method)
 		var buf bytes.Buffer
@@ -191,5 +300,1384 @@ func TestProxy(t *testing.T) {
 		fmt.Printf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, expected, actual)
 		t.FailNow()
 	}
+	var got result
+	json.NewDecoder(res.Body).Decode(&got)
+	if got.Target != "google.com:80" {
+		t.Errorf("target %q, want google.com:80", got.Target)
+	}
+}
+
+func TestConnectRequest(t *testing.T) {
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	expected := "CONNECT google.com:80 HTTP/1.1\r\nHost: google.com:80\r\n\r\n"
+	received := make(chan string, 1)
+	go func() {
+		c, _ := proxy.Accept()
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, len(expected))
+		n, _ := io.ReadFull(c, buf)
+		received <- string(buf[:n])
+		(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(&bytes.Buffer{}),
+		}).Write(c)
+	}()
+
+	var handler http.Handler = proxyHandler{Timeout: 1 * time.Second}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/google.com:80", nil)
+	req.URL.RawQuery = url.Values{
+		"proxy": {proxy.Addr().String()},
+	}.Encode()
+
+	handler.ServeHTTP(res, req)
+	actual := <-received
+	if !reflect.DeepEqual(expected, actual) {
+		_, file, line, _ := runtime.Caller(0)
+		fmt.Printf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, expected, actual)
+		t.FailNow()
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	proxyAddr := proxy.Addr().String()
+	go func() {
+		for {
+			c, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			c.SetDeadline(time.Now().Add(time.Second))
+			req, _ := http.ReadRequest(bufio.NewReader(c))
+			status := http.StatusProxyAuthRequired
+			// base64("bob:p@ss")
+			if req.Header.Get("Proxy-Authorization") == "Basic Ym9iOnBAc3M=" {
+				status = http.StatusOK
+			}
+			(&http.Response{
+				StatusCode: status,
+				Body:       ioutil.NopCloser(&bytes.Buffer{}),
+			}).Write(c)
+			c.Close()
+		}
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("valid credentials", func(t *testing.T) {
+		e.GET("/google.com:80").
+			WithQuery("proxy", "bob:p%40ss@"+proxyAddr).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
+	})
+
+	t.Run("missing credentials", func(t *testing.T) {
+		e.GET("/google.com:80").
+			WithQuery("proxy", proxyAddr).
+			Expect().
+			Status(http.StatusProxyAuthRequired).
+			JSON().Object().
+			ValueEqual("status", "PROXY_AUTH_REQUIRED")
+	})
+}
+
+func TestHealthPath(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second, WithHealthPath("/live")))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	e.GET("/live").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "UP")
+	e.GET("/healthz").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_HOST")
+}
+
+func TestRequestTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected time.Duration
+		err      bool
+	}{
+		{"", 5 * time.Second, false},
+		{"timeout=2s", 2 * time.Second, false},
+		{"timeout=1m", 30 * time.Second, false},
+		{"timeout=0s", 0, true},
+		{"timeout=soon", 0, true},
+	} {
+		req := httptest.NewRequest("GET", "/host:80?"+tc.query, nil)
+		actual, err := requestTimeout(req, 5*time.Second, 30*time.Second)
+		if tc.expected != actual || tc.err != (err != nil) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %q\n\n\texp: %#v\n\n\tgot: %#v (%v)\n\n", filepath.Base(file), line, tc.query, tc.expected, actual, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestIPv6Targets(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("unreachable literal", func(t *testing.T) {
+		e.GET("/[::1]:1").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "HOST_REFUSED")
+	})
+
+	t.Run("malformed literal", func(t *testing.T) {
+		e.GET("/[not:an:ip]:80").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_HOST")
+	})
+
+	t.Run("reachable literal", func(t *testing.T) {
+		l, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skip("IPv6 loopback unavailable:", err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		e.GET("/"+l.Addr().String()).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
+	})
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, tc := range []struct {
+		target     string
+		host, port string
+		err        bool
+	}{
+		{"example.com:443", "example.com", "443", false},
+		{"[2606:4700:4700::1111]:443", "2606:4700:4700::1111", "443", false},
+		{"[fe80::1%eth0]:80", "fe80::1%eth0", "80", false},
+		{"2606:4700:4700::1111:443", "", "", true},
+		{"[example.com:443", "", "", true},
+		{":80", "", "", true},
+		{"example.com:0", "", "", true},
+		{"example.com:99999", "", "", true},
+		{"example.com:65535", "example.com", "65535", false},
+		{"example.com:8000-8010", "example.com", "8000-8010", false},
+		{"example.com\n:80", "", "", true},
+		{"example.com:80\r\nX-Injected: 1", "", "", true},
+		{"exa mple.com:80", "", "", true},
+		{string(bytes.Repeat([]byte("a"), 10<<10)) + ":80", "", "", true},
+	} {
+		host, port, err := parseTarget(tc.target)
+		if tc.host != host || tc.port != port || tc.err != (err != nil) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %q\n\n\texp: %q %q\n\n\tgot: %q %q (%v)\n\n", filepath.Base(file), line, tc.target, tc.host, tc.port, host, port, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestProxyRefused(t *testing.T) {
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		c, _ := proxy.Accept()
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		http.ReadRequest(bufio.NewReader(c))
+		(&http.Response{
+			StatusCode: http.StatusForbidden,
+			Body:       ioutil.NopCloser(&bytes.Buffer{}),
+		}).Write(c)
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+
+	httpexpect.New(t, svr.URL).
+		GET("/google.com:80").
+		WithQuery("proxy", proxy.Addr().String()).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status":            "PROXY_REFUSED",
+			"error":             "proxy answered CONNECT with 403",
+			"proxy_status_text": "Forbidden",
+		})
+}
+
+func TestProxyStatusText(t *testing.T) {
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		c, _ := proxy.Accept()
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 403 Denied by ACL rule 7\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	res, _ := connectViaProxy(context.Background(), proxy.Addr().String(), "example.com", "443", time.Second)
+	if exp := "Denied by ACL rule 7"; res.ProxyStatusText != exp {
+		t.Errorf("got proxy_status_text %q, want %q", res.ProxyStatusText, exp)
+	}
+}
+
+func TestProxyHeadersNotLeaked(t *testing.T) {
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		c, _ := proxy.Accept()
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		http.ReadRequest(bufio.NewReader(c))
+		fmt.Fprint(c, "HTTP/1.1 200 Connection established\r\n"+
+			"X-Upstream: leaked\r\n"+
+			"Set-Cookie: session=upstream\r\n"+
+			"Content-Length: 0\r\n\r\n")
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+
+	res := httpexpect.New(t, svr.URL).
+		GET("/google.com:80").
+		WithQuery("proxy", proxy.Addr().String()).
+		Expect().
+		Status(http.StatusOK)
+	res.Header("X-Upstream").Empty()
+	res.Header("Set-Cookie").Empty()
+	res.JSON().Object().ValueEqual("status", "OK")
+}
+
+func TestServeTLS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svr := &http.Server{Addr: addr, Handler: Run(time.Second)}
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, []*http.Server{svr}, certFile, keyFile, time.Second)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	var res *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if res, err = client.Get("https://" + addr + "/healthz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.TLS == nil || res.StatusCode != http.StatusOK {
+		t.Errorf("expected a 200 over TLS, got %d (tls %v)", res.StatusCode, res.TLS != nil)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeAddrs(t *testing.T) {
+	var addrs []string
+	var svrs []*http.Server
+	for i := 0; i < 2; i++ {
+		l, _ := net.Listen("tcp", "127.0.0.1:")
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+		svrs = append(svrs, &http.Server{Addr: addrs[i], Handler: Run(time.Second)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, svrs, "", "", time.Second)
+	}()
+
+	for _, addr := range addrs {
+		var res *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if res, err = http.Get("http://" + addr + "/healthz"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected a 200, got %d", addr, res.StatusCode)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	for _, addr := range addrs {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Errorf("%s still accepts connections after shutdown", addr)
+		}
+	}
+}
+
+func TestServeAddrsBindFailure(t *testing.T) {
+	taken, _ := net.Listen("tcp", "127.0.0.1:")
+	defer taken.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	free := l.Addr().String()
+	l.Close()
+
+	svrs := []*http.Server{
+		{Addr: free, Handler: Run(time.Second)},
+		{Addr: taken.Addr().String(), Handler: Run(time.Second)},
+	}
+	if err := serve(context.Background(), svrs, "", "", time.Second); err == nil {
+		t.Fatal("expected an error binding an address in use")
+	}
+	// the address that could be bound is let go again
+	l, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Fatalf("%s was left bound: %v", free, err)
+	}
+	l.Close()
+}
+
+func TestRetries(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	addr := l.Addr().String()
+	l.Close()
+
+	// Nothing listens on addr for the first dial; the listener comes up
+	// before the first retry.
+	up := make(chan net.Listener)
+	go func() {
+		time.Sleep(retryBackoff / 2)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			close(up)
+			return
+		}
+		up <- l
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+
+	e := httpexpect.New(t, svr.URL)
+	obj := e.GET("/"+addr).
+		WithQuery("retries", 3).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	obj.ValueEqual("status", "OK")
+	obj.Value("attempts").Number().Gt(1)
+	if l := <-up; l != nil {
+		l.Close()
+	}
+
+	e.GET("/nosuchhost.invalid:80").
+		WithQuery("retries", 3).
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status":   "DNS_RESOLUTION_FAIL",
+			"attempts": 1,
+		})
+
+	e.GET("/"+addr).
+		WithQuery("retries", maxRetries+1).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_RETRIES")
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Host != "google.com:80" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	proxyURL := "https://" + proxy.Listener.Addr().String()
+
+	t.Run("trusted proxy", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(proxy.Certificate())
+		svr := httptest.NewServer(Run(time.Second, WithRootCAs(pool)))
+		defer svr.Close()
+
+		httpexpect.New(t, svr.URL).
+			GET("/google.com:80").
+			WithQuery("proxy", proxyURL).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "OK",
+				"proxy":  proxyURL,
+			})
+	})
+
+	t.Run("untrusted proxy", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second))
+		defer svr.Close()
+
+		httpexpect.New(t, svr.URL).
+			GET("/google.com:80").
+			WithQuery("proxy", proxyURL).
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "PROXY_TLS_FAIL")
+	})
+}
+
+func TestResolvedIPs(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("resolvable", func(t *testing.T) {
+		obj := e.GET("/localhost:" + port).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ValueEqual("status", "OK")
+		obj.Value("resolved_ips").Array().Contains("127.0.0.1")
+	})
+
+	t.Run("not resolvable", func(t *testing.T) {
+		obj := e.GET("/nosuchhost.invalid:80").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object()
+		obj.ValueEqual("status", "DNS_RESOLUTION_FAIL")
+		obj.Value("error").String().Contains("nosuchhost.invalid")
+		obj.NotContainsKey("resolved_ips")
+	})
+}
+
+func TestSocketAddrs(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	remote := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		remote <- c.RemoteAddr().String()
+		c.Close()
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	obj := e.GET("/" + l.Addr().String()).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	obj.ValueEqual("remote_addr", l.Addr().String())
+	obj.ValueEqual("local_addr", <-remote)
+
+	l.Close()
+	obj = e.GET("/" + l.Addr().String()).
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object()
+	obj.NotContainsKey("local_addr")
+	obj.NotContainsKey("remote_addr")
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDialStatus(t *testing.T) {
+	for _, c := range []struct {
+		err error
+		exp string
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, "HOST_CONNECT_TIMEOUT"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "HOST_REFUSED"},
+		{&net.DNSError{Err: "no such host", Name: "nosuchhost.invalid", IsNotFound: true}, "DNS_RESOLUTION_FAIL"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, "HOST_CONNECT_FAIL"},
+	} {
+		if got := dialStatus(c.err); got != c.exp {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.exp, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestSourceAddr(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	remote := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		remote <- host
+		c.Close()
+	}()
 
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("bound", func(t *testing.T) {
+		e.GET("/"+l.Addr().String()).
+			WithQuery("from", "127.0.0.2").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
+		if exp, got := "127.0.0.2", <-remote; exp != got {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, exp, got)
+			t.Fail()
+		}
+	})
+
+	t.Run("not an address", func(t *testing.T) {
+		e.GET("/"+l.Addr().String()).
+			WithQuery("from", "eth0").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_SOURCE_ADDR")
+	})
+
+	t.Run("not local", func(t *testing.T) {
+		e.GET("/"+l.Addr().String()).
+			WithQuery("from", "192.0.2.1").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_SOURCE_ADDR")
+	})
+}
+
+func TestProxyFunc(t *testing.T) {
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		for {
+			c, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			c.SetDeadline(time.Now().Add(time.Second))
+			http.ReadRequest(bufio.NewReader(c))
+			(&http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(&bytes.Buffer{}),
+			}).Write(c)
+			c.Close()
+		}
+	}()
+	proxyURL := &url.URL{Scheme: "http", User: url.UserPassword("bob", "s3cret"), Host: proxy.Addr().String()}
+
+	svr := httptest.NewServer(Run(time.Second, WithProxyFunc(func(r *http.Request) (*url.URL, error) {
+		if r.URL.Hostname() == "direct.invalid" {
+			return nil, nil
+		}
+		return proxyURL, nil
+	})))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("routed through proxy", func(t *testing.T) {
+		e.GET("/example.com:443").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "OK",
+				"proxy":  proxyURL.Redacted(),
+			})
+	})
+
+	t.Run("excluded target", func(t *testing.T) {
+		obj := e.GET("/direct.invalid:443").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object()
+		obj.ValueEqual("status", "DNS_RESOLUTION_FAIL")
+		obj.NotContainsKey("proxy")
+	})
+
+	t.Run("explicit proxy wins", func(t *testing.T) {
+		e.GET("/example.com:443").
+			WithQuery("proxy", "127.0.0.1:1").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "PROXY_UNREACHABLE",
+				"proxy":  "127.0.0.1:1",
+			})
+	})
+}
+
+func TestProxyHeaders(t *testing.T) {
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		for {
+			c, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			c.SetDeadline(time.Now().Add(time.Second))
+			http.ReadRequest(bufio.NewReader(c))
+			fmt.Fprint(c, "HTTP/1.1 200 Connection established\r\n"+
+				"Via: 1.1 squid\r\n"+
+				"X-Cache: MISS from squid\r\n"+
+				"X-Upstream: hidden\r\n"+
+				"Content-Length: 0\r\n\r\n")
+			c.Close()
+		}
+	}()
+
+	for _, c := range []struct {
+		name string
+		opts []Option
+		exp  map[string]interface{}
+	}{
+		{"default allowlist", nil, map[string]interface{}{
+			"Via":     "1.1 squid",
+			"X-Cache": "MISS from squid",
+		}},
+		{"configured allowlist", []Option{WithProxyHeaders([]string{"x-upstream"})}, map[string]interface{}{
+			"X-Upstream": "hidden",
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			svr := httptest.NewServer(Run(time.Second, c.opts...))
+			defer svr.Close()
+
+			httpexpect.New(t, svr.URL).
+				GET("/google.com:80").
+				WithQuery("proxy", proxy.Addr().String()).
+				Expect().
+				Status(http.StatusOK).
+				JSON().Object().
+				Value("proxy_headers").Object().Equal(c.exp)
+		})
+	}
+}
+
+func TestProxyValidation(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	for _, c := range []struct {
+		name, target, proxy, status string
+	}{
+		{"proxy equals target", "example.com:3128", "example.com:3128", "PROXY_EQUALS_TARGET"},
+		{"proxy URL equals target", "Example.com:3128", "http://example.com:3128", "PROXY_EQUALS_TARGET"},
+		{"missing port", "example.com:443", "http://proxy.example.com", "INVALID_PROXY"},
+		{"unsupported scheme", "example.com:443", "ftp://proxy.example.com:21", "INVALID_PROXY"},
+		{"unparseable", "example.com:443", "http://[::1", "INVALID_PROXY"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			e.GET("/"+c.target).
+				WithQuery("proxy", c.proxy).
+				Expect().
+				Status(http.StatusBadRequest).
+				JSON().Object().
+				ContainsMap(map[string]interface{}{
+					"status": c.status,
+					"proxy":  c.proxy,
+				})
+		})
+	}
+}
+
+func TestFamily(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("ip4", func(t *testing.T) {
+		obj := e.GET("/localhost:"+port).
+			WithQuery("family", "ip4").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ValueEqual("status", "OK")
+		obj.ValueEqual("family", "ip4")
+		obj.ValueEqual("resolved_ips", []string{"127.0.0.1"})
+	})
+
+	t.Run("dual", func(t *testing.T) {
+		e.GET("/127.0.0.1:"+port).
+			WithQuery("family", "dual").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("family", "ip4")
+	})
+
+	t.Run("no AAAA record", func(t *testing.T) {
+		e.GET("/127.0.0.1:"+port).
+			WithQuery("family", "ip6").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "NO_AAAA_RECORD")
+	})
+
+	t.Run("unknown family", func(t *testing.T) {
+		e.GET("/127.0.0.1:"+port).
+			WithQuery("family", "ipx").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_FAMILY")
+	})
+}
+
+// getRawPath GETs path, sent on the request line exactly as given rather than
+// escaped again, from the server at base and decodes the result.
+func getRawPath(t *testing.T, base, path string) (int, result) {
+	req, err := http.NewRequest(http.MethodGet, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.URL.Opaque = path
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var r result
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, r
+}
+
+func TestConnectViaProxy(t *testing.T) {
+	// rawProxy answers the first CONNECT on each connection with reply, or
+	// sits on the request when reply is empty.
+	rawProxy := func(reply string) (string, func()) {
+		l, _ := net.Listen("tcp", "127.0.0.1:")
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+						return
+					}
+					if reply == "" {
+						time.Sleep(time.Second)
+						return
+					}
+					io.WriteString(c, reply)
+				}()
+			}
+		}()
+		return l.Addr().String(), func() { l.Close() }
+	}
+
+	for _, c := range []struct {
+		name   string
+		reply  string
+		status string
+		code   int
+	}{
+		{"ok", "HTTP/1.1 200 Connection established\r\n\r\n", "OK", 0},
+		{"refused", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", "PROXY_REFUSED", http.StatusForbidden},
+		{"auth", "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n", "PROXY_AUTH_REQUIRED", http.StatusProxyAuthRequired},
+		{"partial response", "HTTP/1.1 200 Conn", "PROXY_BAD_RESPONSE", http.StatusBadGateway},
+		{"truncated status line", "HTTP/1.1 2", "PROXY_BAD_RESPONSE", http.StatusBadGateway},
+		{"garbage", "SSH-2.0-OpenSSH_9.6\r\n", "PROXY_BAD_RESPONSE", http.StatusBadGateway},
+		{"timeout", "", "PROXY_CONNECT_ERROR", http.StatusGatewayTimeout},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			proxy, stop := rawProxy(c.reply)
+			defer stop()
+			res, err := connectViaProxy(context.Background(), proxy, "example.com", "443", 100*time.Millisecond)
+			code := 0
+			if err != nil {
+				var pe *proxyError
+				if !errors.As(err, &pe) {
+					t.Fatalf("expected a *proxyError, got %T", err)
+				}
+				code = pe.Code
+			}
+			for _, v := range []struct{ exp, got interface{} }{
+				{c.status, res.Status},
+				{proxy, res.Proxy},
+				{c.code, code},
+			} {
+				if !reflect.DeepEqual(v.exp, v.got) {
+					_, file, line, _ := runtime.Caller(0)
+					t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, v.exp, v.got)
+					t.Fail()
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCanceled(t *testing.T) {
+	dialing := make(chan struct{})
+	checker := plainTest{
+		Dialer: net.Dialer{
+			Timeout: 10 * time.Second,
+			// hold the dial until it is canceled, as a dial to an address
+			// that never answers would be
+			ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+				close(dialing)
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		},
+		Retries: maxRetries,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := checker.Check(ctx, "127.0.0.1", "80")
+		done <- err
+	}()
+	<-dialing
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the check to be canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("check still running after its context was canceled")
+	}
+
+	res, err := connectViaProxy(ctx, "127.0.0.1:3128", "example.com", "443", 10*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the proxy dial to be canceled, got %v", err)
+	}
+	if exp, got := "REQUEST_CANCELED", res.Status; exp != got {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, exp, got)
+		t.Fail()
+	}
+}
+
+func TestProxyResponseCanceled(t *testing.T) {
+	// The proxy reads the CONNECT and never answers it.
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		for {
+			c, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				http.ReadRequest(bufio.NewReader(c))
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	code, res := proxyHandler{Timeout: 10 * time.Second}.check(ctx, proxy.Addr().String(), "example.com", "443")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v to notice the cancellation", elapsed)
+	}
+	for _, c := range []struct{ exp, got interface{} }{
+		{statusClientClosedRequest, code},
+		{"REQUEST_CANCELED", res.Status},
+		{"ERR_CANCELED", res.Code},
+	} {
+		if c.exp != c.got {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.exp, c.got)
+			t.Fail()
+		}
+	}
+
+	// a proxy that is slow to answer within the timeout is not canceled
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, res = proxyHandler{Timeout: 10 * time.Second}.check(ctx, proxy.Addr().String(), "example.com", "443")
+	if res.Status == "REQUEST_CANCELED" {
+		t.Errorf("a check past its deadline was reported as canceled: %+v", res)
+	}
+}
+
+func TestProxyClosedConnection(t *testing.T) {
+	// The proxy accepts each connection and closes it without writing
+	// anything. It reads the CONNECT first so that the close is a clean
+	// one rather than a reset over unread data.
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	go func() {
+		for {
+			c, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				http.ReadRequest(bufio.NewReader(c))
+				c.Close()
+			}()
+		}
+	}()
+
+	svr := httptest.NewServer(Run(5 * time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	e.GET("/example.com:443").
+		WithQuery("proxy", proxy.Addr().String()).
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status": "PROXY_CLOSED_CONNECTION",
+			"code":   "ERR_EOF",
+			"proxy":  proxy.Addr().String(),
+		})
+}
+
+func TestProxyDrain(t *testing.T) {
+	// The proxy refuses the tunnel with a body it never stops sending.
+	proxy, _ := net.Listen("tcp", "127.0.0.1:")
+	defer proxy.Close()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		c, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nTransfer-Encoding: chunked\r\n\r\n")
+		chunk := fmt.Sprintf("%x\r\n%s\r\n", 1024, bytes.Repeat([]byte("x"), 1024))
+		for {
+			if _, err := io.WriteString(c, chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	p := proxyHandler{Timeout: 5 * time.Second, DrainLimit: 4096}
+	code, res := p.check(context.Background(), proxy.Addr().String(), "example.com", "443")
+	if code != http.StatusForbidden || res.Status != "PROXY_REFUSED" {
+		t.Errorf("expected 403 PROXY_REFUSED, got %d %s", code, res.Status)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the body is still being drained")
+	}
+}
+
+func TestPprof(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	httpexpect.New(t, svr.URL).
+		GET("/debug/pprof/").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_HOST")
+
+	svr = httptest.NewServer(Run(time.Second, WithPprof(true), WithToken("s3cret")))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+	e.GET("/debug/pprof/").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/debug/pprof/goroutine").
+		WithQuery("debug", "1").
+		WithHeader("Authorization", "Bearer s3cret").
+		Expect().
+		Status(http.StatusOK).
+		Body().Contains("goroutine profile")
+}
+
+func TestUnixSocket(t *testing.T) {
+	// socket paths are limited to about 100 bytes, which t.TempDir can exceed
+	dir, err := os.MkdirTemp("", "willitgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "app.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("listening", func(t *testing.T) {
+		e.GET("/unix:"+sock).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("target", "unix:"+sock).
+			ValueEqual("remote_addr", sock).
+			NotContainsKey("family")
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		e.GET("/unix:"+filepath.Join(dir, "missing.sock")).
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "HOST_CONNECT_FAIL")
+	})
+
+	t.Run("with a mode", func(t *testing.T) {
+		e.GET("/unix:"+sock).
+			WithQuery("mode", "http").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_PROTO")
+	})
+
+	t.Run("proto unix with a port", func(t *testing.T) {
+		e.GET("/127.0.0.1:80").
+			WithQuery("proto", "unix").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_PROTO")
+	})
+
+	t.Run("denied with an allowlist", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second, WithAllowlist([]string{"10.0.0.0/8"})))
+		defer svr.Close()
+		httpexpect.New(t, svr.URL).
+			GET("/unix:"+sock).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "TARGET_DENIED")
+	})
+}
+
+func TestScanMode(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("open", func(t *testing.T) {
+		e.GET("/"+l.Addr().String()).
+			WithQuery("mode", "scan").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("method", "full-connect")
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		e.GET("/127.0.0.1:1").
+			WithQuery("mode", "scan").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "HOST_REFUSED").
+			ValueEqual("method", "full-connect")
+	})
+
+	t.Run("tcp mode", func(t *testing.T) {
+		e.GET("/" + l.Addr().String()).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			NotContainsKey("method")
+	})
+}
+
+func TestFallbackProxies(t *testing.T) {
+	good, _, stopGood := fakeKeepAliveProxy(t, http.StatusOK)
+	defer stopGood()
+	refusing, _, stopRefusing := fakeKeepAliveProxy(t, http.StatusForbidden)
+	defer stopRefusing()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("falls back", func(t *testing.T) {
+		obj := e.GET("/example.com:443").
+			WithQuery("proxy", "127.0.0.1:1,"+refusing+","+good).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ValueEqual("status", "OK")
+		obj.ValueEqual("proxy", good)
+		attempts := obj.Value("proxy_attempts").Array()
+		attempts.Length().Equal(2)
+		attempts.Element(0).Object().ContainsMap(map[string]interface{}{
+			"proxy":  "127.0.0.1:1",
+			"status": "PROXY_UNREACHABLE",
+		})
+		attempts.Element(1).Object().ContainsMap(map[string]interface{}{
+			"proxy":  refusing,
+			"status": "PROXY_REFUSED",
+		})
+	})
+
+	t.Run("all fail", func(t *testing.T) {
+		obj := e.GET("/example.com:443").
+			WithQuery("proxy", "127.0.0.1:1,"+refusing).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object()
+		obj.ValueEqual("status", "PROXY_CONNECT_ERROR")
+		obj.ValueEqual("proxy", refusing)
+		obj.Value("proxy_attempts").Array().Length().Equal(2)
+	})
+
+	t.Run("first works", func(t *testing.T) {
+		e.GET("/example.com:443").
+			WithQuery("proxy", good+",127.0.0.1:1").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("proxy", good).
+			NotContainsKey("proxy_attempts")
+	})
+}
+
+func TestProxyTimeout(t *testing.T) {
+	// answers CONNECT only after a pause longer than the proxy timeout
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+					return
+				}
+				time.Sleep(150 * time.Millisecond)
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+			}()
+		}
+	}()
+	proxy := l.Addr().String()
+
+	t.Run("slow tunnel within the check timeout", func(t *testing.T) {
+		p := proxyHandler{Timeout: time.Second, ProxyTimeout: 100 * time.Millisecond}
+		res, err := p.connect(context.Background(), proxy, "example.com", "443")
+		if err != nil || res.Status != "OK" {
+			t.Errorf("got %s (%v), want OK", res.Status, err)
+		}
+	})
+
+	t.Run("dial past the proxy timeout", func(t *testing.T) {
+		p := proxyHandler{Timeout: time.Second, ProxyTimeout: time.Nanosecond}
+		res, _ := p.connect(context.Background(), proxy, "example.com", "443")
+		if res.Status != "PROXY_UNREACHABLE" || res.Code != "ERR_TIMEOUT" {
+			t.Errorf("got %s %s, want PROXY_UNREACHABLE ERR_TIMEOUT", res.Status, res.Code)
+		}
+	})
+
+	for _, c := range []struct {
+		timeout, proxyTimeout, exp time.Duration
+	}{
+		{5 * time.Second, 0, 5 * time.Second},
+		{5 * time.Second, 2 * time.Second, 2 * time.Second},
+		{5 * time.Second, 10 * time.Second, 5 * time.Second},
+		{0, 2 * time.Second, 2 * time.Second},
+	} {
+		got := proxyHandler{Timeout: c.timeout, ProxyTimeout: c.proxyTimeout}.dialTimeout()
+		if got != c.exp {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.exp, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	// a DNS server that never answers
+	silent, _ := net.ListenPacket("udp", "127.0.0.1:")
+	defer silent.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+
+	svr := httptest.NewServer(Run(5 * time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("dns", func(t *testing.T) {
+		start := time.Now()
+		e.GET("/slow.example:80").
+			WithQuery("resolver", silent.LocalAddr().String()).
+			WithQuery("dns-timeout", "100ms").
+			Expect().
+			Status(http.StatusGatewayTimeout).
+			JSON().Object().
+			ValueEqual("status", "DNS_TIMEOUT")
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("resolution took %v, past its budget", elapsed)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		e.GET("/"+l.Addr().String()).
+			WithQuery("connect-timeout", "1ns").
+			Expect().
+			Status(http.StatusGatewayTimeout).
+			JSON().Object().
+			ValueEqual("status", "CONNECT_TIMEOUT")
+	})
+
+	for _, q := range []map[string]string{
+		{"dns-timeout": "soon"},
+		{"connect-timeout": "-1s"},
+		{"connect-timeout": "1s", "proxy": "127.0.0.1:3128"},
+	} {
+		req := e.GET("/" + l.Addr().String())
+		for k, v := range q {
+			req = req.WithQuery(k, v)
+		}
+		req.Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_TIMEOUT")
+	}
 }
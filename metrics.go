@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics tracks check outcomes and serves them for Prometheus to scrape.
+// Each has a registry of its own, with the Go runtime and process collectors
+// the default registry carries, so that servers run side by side, as in the
+// tests, count apart.
+type metrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	checks     *prometheus.CounterVec
+	duration   prometheus.Histogram
+	inFlight   prometheus.Gauge
+	coalesced  prometheus.Counter
+	poolHits   prometheus.Counter
+	poolMisses prometheus.Counter
+	drains     prometheus.Gauge
+
+	// statuses tallies checks by result status, a *atomic.Uint64 for each,
+	// for /stats to read apart from the registry.
+	statuses sync.Map
+	// started is when the metrics began to be kept, for /stats to report
+	// uptime from.
+	started time.Time
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "willitgo_checks_total",
+			Help: "Checks performed, by result status.",
+		}, []string{"status"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "willitgo_check_duration_seconds",
+			Help:    "Time taken to run a check.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "willitgo_checks_in_flight",
+			Help: "Checks currently running.",
+		}),
+		coalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "willitgo_checks_coalesced_total",
+			Help: "Checks that shared the dial of an identical check running at the same time.",
+		}),
+		poolHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "willitgo_proxy_pool_hits_total",
+			Help: "Proxy checks that reused an idle proxy connection.",
+		}),
+		poolMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "willitgo_proxy_pool_misses_total",
+			Help: "Proxy checks that found no idle proxy connection to reuse.",
+		}),
+		drains: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "willitgo_proxy_drains_active",
+			Help: "CONNECT response bodies being discarded in the background.",
+		}),
+		started: time.Now(),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.checks, m.duration, m.inFlight, m.coalesced,
+		m.poolHits, m.poolMisses, m.drains,
+	)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// observe records a finished check with the given result status.
+func (m *metrics) observe(status string, d time.Duration) {
+	m.checks.WithLabelValues(status).Inc()
+	m.duration.Observe(d.Seconds())
+	n, ok := m.statuses.Load(status)
+	if !ok {
+		n, _ = m.statuses.LoadOrStore(status, new(atomic.Uint64))
+	}
+	n.(*atomic.Uint64).Add(1)
+}
+
+// instrument counts each request served by h as a check, using the status
+// of the result it writes.
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		rec := &resultRecorder{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+		if rec.status != "" {
+			m.observe(rec.status, time.Since(start))
+		}
+	})
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// stats summarises, for /stats, the checks served since startup.
+type stats struct {
+	StartedAt     string  `json:"started_at"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Checks        uint64  `json:"checks"`
+	// SuccessRate is the fraction of checks that were OK, from 0 to 1. It
+	// is left out until a check has been made.
+	SuccessRate *float64          `json:"success_rate,omitempty"`
+	Statuses    map[string]uint64 `json:"statuses"`
+}
+
+// serveStats answers /stats with the checks counted since startup, summed up
+// for reading at a glance rather than scraping.
+func (m *metrics) serveStats(w http.ResponseWriter, r *http.Request) {
+	s := stats{
+		StartedAt:     m.started.UTC().Format(time.RFC3339),
+		UptimeSeconds: time.Since(m.started).Seconds(),
+		Statuses:      map[string]uint64{},
+	}
+	m.statuses.Range(func(status, n interface{}) bool {
+		count := n.(*atomic.Uint64).Load()
+		s.Statuses[status.(string)] = count
+		s.Checks += count
+		return true
+	})
+	if s.Checks > 0 {
+		rate := float64(s.Statuses["OK"]) / float64(s.Checks)
+		s.SuccessRate = &rate
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	e.GET("/" + ts.Listener.Addr().String()).Expect().Status(http.StatusOK)
+	e.GET("/127.0.0.1:1").Expect().StatusRange(httpexpect.Status5xx)
+	e.POST("/batch").
+		WithJSON(map[string]interface{}{
+			"targets": []map[string]string{{"host": host, "port": port}},
+		}).
+		Expect().
+		Status(http.StatusOK)
+	e.GET("/healthz").Expect().Status(http.StatusOK)
+
+	body := e.GET("/metrics").
+		Expect().
+		Status(http.StatusOK).
+		Body()
+	body.Contains(`willitgo_checks_total{status="OK"} 2`)
+	body.Contains(`willitgo_checks_total{status="HOST_REFUSED"} 1`)
+	body.Contains(`willitgo_check_duration_seconds_count 3`)
+	body.Contains(`willitgo_check_duration_seconds_bucket{le="+Inf"} 3`)
+	body.Contains(`willitgo_checks_in_flight 0`)
+	body.Contains(`willitgo_checks_coalesced_total 0`)
+	body.NotContains(`status="UP"`)
+}
+
+func TestStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	obj := e.GET("/stats").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	obj.ValueEqual("checks", 0).
+		ValueEqual("statuses", map[string]interface{}{}).
+		NotContainsKey("success_rate")
+	obj.Value("started_at").String().NotEmpty()
+
+	e.GET("/" + ts.Listener.Addr().String()).Expect().Status(http.StatusOK)
+	e.GET("/" + ts.Listener.Addr().String()).Expect().Status(http.StatusOK)
+	e.GET("/" + ts.Listener.Addr().String()).Expect().Status(http.StatusOK)
+	e.GET("/127.0.0.1:1").Expect().StatusRange(httpexpect.Status5xx)
+	e.GET("/healthz").Expect().Status(http.StatusOK)
+
+	obj = e.GET("/stats").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	obj.ValueEqual("checks", 4).
+		ValueEqual("success_rate", 0.75).
+		ValueEqual("statuses", map[string]interface{}{"OK": 3, "HOST_REFUSED": 1})
+	obj.Value("uptime_seconds").Number().Gt(0)
+}
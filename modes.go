@@ -0,0 +1,62 @@
+package main
+
+import "net/http"
+
+// modeInfo describes a check mode, or a proto of the default tcp mode, for
+// /modes.
+type modeInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Params are the query parameters that apply to this mode only.
+	Params []string `json:"params,omitempty"`
+	// Proxy is set for the modes that can be checked through a proxy: tcp
+	// opens the tunnel, and the others run over it.
+	Proxy bool `json:"proxy,omitempty"`
+}
+
+// modes describes the check modes validate accepts, in the order /modes lists
+// them. Every mode has its Checker in checkers.
+var modes = []modeInfo{
+	{Name: "tcp", Description: "open a TCP connection, optionally writing a payload and matching the reply; the default", Params: []string{"proxy", "proxy-http2", "retries", "send", "expect", "all-ips", "require"}, Proxy: true},
+	{Name: "scan", Description: "open and at once close a TCP connection, reporting the full-connect method", Params: []string{"retries"}},
+	{Name: "tls", Description: "complete a TLS handshake and report the certificate", Params: []string{"alpn"}, Proxy: true},
+	{Name: "http", Description: "send a GET and fail on a 5xx status", Params: []string{"path", "follow"}, Proxy: true},
+	{Name: "https", Description: "send a GET over TLS and fail on a 5xx status", Params: []string{"path", "follow"}, Proxy: true},
+	{Name: "dns", Description: "look the host up, optionally for a given record type", Params: []string{"record"}},
+	{Name: "grpc", Description: "call the standard gRPC health check", Params: []string{"tls"}, Proxy: true},
+	{Name: "ws", Description: "complete a WebSocket upgrade, optionally sending a ping", Params: []string{"path", "probe"}, Proxy: true},
+	{Name: "wss", Description: "complete a WebSocket upgrade over TLS, optionally sending a ping", Params: []string{"path", "probe"}, Proxy: true},
+	{Name: "smtp", Description: "read the SMTP greeting, optionally sending EHLO", Params: []string{"probe"}, Proxy: true},
+	{Name: "ssh", Description: "read the SSH identification string", Proxy: true},
+	{Name: "ping", Description: "send an ICMP echo request; the port is ignored"},
+}
+
+// protos are the transports the tcp mode can use instead of TCP.
+var protos = []modeInfo{
+	{Name: "tcp", Description: "the default"},
+	{Name: "udp", Description: "set up a UDP socket, optionally sending a probe datagram", Params: []string{"probe"}},
+	{Name: "unix", Description: "connect to a unix socket, given as /unix:/path/to.sock"},
+}
+
+// commonParams are the query parameters that apply to every mode.
+var commonParams = []string{"timeout", "from", "family", "resolver", "proxy-protocol", "dns-timeout", "connect-timeout", "read-timeout", "raw-error", "format", "http-ok"}
+
+// lookupMode returns the registered mode called name.
+func lookupMode(name string) (modeInfo, bool) {
+	for _, m := range modes {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return modeInfo{}, false
+}
+
+// modesHandler serves /modes, describing the supported modes and protos and
+// the query parameters they accept.
+func modesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Modes  []modeInfo `json:"modes"`
+		Protos []modeInfo `json:"protos"`
+		Params []string   `json:"params"`
+	}{modes, protos, commonParams})
+}
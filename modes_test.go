@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestModes(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second, WithToken("s3cret")))
+	defer svr.Close()
+
+	obj := httpexpect.New(t, svr.URL).
+		GET("/modes").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	obj.Value("modes").Array().Length().Equal(len(modes))
+	obj.Value("modes").Array().Element(0).Object().
+		ValueEqual("name", "tcp").
+		ValueEqual("proxy", true)
+	obj.Value("protos").Array().Length().Equal(len(protos))
+	obj.Value("params").Array().Contains("timeout")
+}
+
+func TestModesValidate(t *testing.T) {
+	for _, m := range modes {
+		if status, err := (target{Mode: m.Name}).validate(); err != nil {
+			t.Errorf("mode %q: %s %v", m.Name, status, err)
+		}
+		status, _ := (target{Mode: m.Name, Proxy: "127.0.0.1:3128"}).validate()
+		if (status == "") != m.Proxy {
+			t.Errorf("mode %q through a proxy: got %q", m.Name, status)
+		}
+	}
+	if status, _ := (target{Mode: "gopher"}).validate(); status != "INVALID_MODE" {
+		t.Errorf("unknown mode: got %q, want INVALID_MODE", status)
+	}
+}
+
+func TestDefaultMode(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	proxy, stop := fakeTunnelProxy(t, http.StatusOK)
+	defer stop()
+
+	svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots), WithDefaultMode("tls")))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+	target := "/" + tlsServer.Listener.Addr().String()
+
+	// no mode given: a TLS handshake, also through a proxy
+	e.GET(target).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ContainsKey("tls_version")
+	e.GET(target).
+		WithQuery("proxy", proxy).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ContainsKey("tls_version").
+		ValueEqual("proxy", proxy)
+	// options of the default mode need no ?mode=
+	e.GET(target).
+		WithQuery("alpn", "http/1.1").
+		Expect().
+		Status(http.StatusOK)
+
+	// a mode given, tcp included, overrides the default
+	e.GET(target).
+		WithQuery("mode", "tcp").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		NotContainsKey("tls_version")
+	e.GET(target).
+		WithQuery("mode", "tcp").
+		WithQuery("send", "00").
+		Expect().
+		Status(http.StatusOK)
+	e.GET(target).
+		WithQuery("send", "00").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_PAYLOAD")
+
+	// udp checks are left in tcp mode
+	e.GET("/127.0.0.1:9").
+		WithQuery("proto", "udp").
+		Expect().
+		Status(http.StatusOK)
+}
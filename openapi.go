@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 description of the service's endpoints. It is
+// kept by hand, so new query parameters and result fields need adding to it.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIHandler serves the OpenAPI document.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json;charset=utf-8")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestOpenAPI(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second, WithToken("s3cret")))
+	defer svr.Close()
+
+	obj := httpexpect.New(t, svr.URL).
+		GET("/openapi.json").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	obj.ValueEqual("openapi", "3.0.3")
+	obj.Value("paths").Object().ContainsKey("/{target}").ContainsKey("/batch")
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]interface{}{
+		"result":    result{},
+		"target":    target{},
+		"buildInfo": buildInfo{},
+		"stats":     stats{},
+		"mode":      modeInfo{},
+	} {
+		var exp, got []string
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			if !typ.Field(i).IsExported() {
+				continue
+			}
+			exp = append(exp, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+		}
+		for prop := range spec.Components.Schemas[name].Properties {
+			got = append(got, prop)
+		}
+		sort.Strings(exp)
+		sort.Strings(got)
+		if !reflect.DeepEqual(exp, got) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, name, exp, got)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http/httpguts"
+)
+
+// Option configures the handler returned by Run.
+type Option func(*config)
+
+type config struct {
+	healthPath string
+	canary     string
+	pprof      bool
+	maxTimeout time.Duration
+
+	batchWorkers    int
+	maxBatchTargets int
+	maxConcurrent   int
+	retryAfter      time.Duration
+
+	rootCAs     *x509.CertPool
+	clientCert  *tls.Certificate
+	certWarning time.Duration
+
+	token          string
+	corsOrigins    []string
+	allow          *allowlist
+	denyPrivate    bool
+	logger         *slog.Logger
+	metrics        *metrics
+	tracerProvider trace.TracerProvider
+	proxyFunc      func(*http.Request) (*url.URL, error)
+
+	proxyHeaders []string
+	proxyIdle    time.Duration
+	proxyTimeout time.Duration
+	proxyDrain   int64
+	proxyPool    *proxyPool
+	drainer      *drainer
+
+	cacheTTL time.Duration
+	cache    *resultCache
+
+	keepAlive     time.Duration
+	fallbackDelay time.Duration
+
+	userAgent string
+	header    http.Header
+
+	defaultMode string
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{
+		healthPath: "/healthz",
+		maxTimeout: 30 * time.Second,
+
+		batchWorkers:    10,
+		maxBatchTargets: 1000,
+		maxConcurrent:   100,
+		retryAfter:      5 * time.Second,
+
+		certWarning: 30 * 24 * time.Hour,
+
+		proxyHeaders: []string{"Via", "X-Cache"},
+		proxyDrain:   defaultDrainLimit,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithHealthPath sets the path of the liveness endpoint. It defaults to
+// /healthz.
+func WithHealthPath(path string) Option {
+	return func(c *config) {
+		c.healthPath = path
+	}
+}
+
+// WithCanary makes /readyz dial the host:port canary and report the service
+// ready only when that succeeds. Without a canary /readyz always answers
+// READY.
+func WithCanary(addr string) Option {
+	return func(c *config) {
+		c.canary = addr
+	}
+}
+
+// WithPprof serves the net/http/pprof profiles under /debug/pprof/. They
+// expose the command line and the program's internals, and CPU profiles and
+// traces slow the service while they run, so they are off by default and sit
+// behind the token when one is set.
+func WithPprof(enable bool) Option {
+	return func(c *config) {
+		c.pprof = enable
+	}
+}
+
+// WithMaxTimeout caps the per-request ?timeout= override. It defaults to 30s.
+func WithMaxTimeout(max time.Duration) Option {
+	return func(c *config) {
+		c.maxTimeout = max
+	}
+}
+
+// WithBatchWorkers bounds how many checks a single /batch request runs
+// concurrently. It defaults to 10.
+func WithBatchWorkers(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.batchWorkers = n
+		}
+	}
+}
+
+// WithMaxBatchTargets caps how many targets a single /batch or /stream
+// request may list; longer lists get 413 TOO_MANY_TARGETS before any check
+// runs, and their bodies are read no further than the first target over. It
+// defaults to 1000.
+func WithMaxBatchTargets(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.maxBatchTargets = n
+		}
+	}
+}
+
+// WithMaxConcurrent bounds how many check and batch requests are served at
+// once; further requests get 503 BUSY. It defaults to 100, and 0 removes the
+// limit.
+func WithMaxConcurrent(n int) Option {
+	return func(c *config) {
+		if n >= 0 {
+			c.maxConcurrent = n
+		}
+	}
+}
+
+// WithRetryAfter sets the Retry-After hint sent with 503 BUSY and 504 timeout
+// responses. It defaults to 5s, and 0 omits the header.
+func WithRetryAfter(d time.Duration) Option {
+	return func(c *config) {
+		if d >= 0 {
+			c.retryAfter = d
+		}
+	}
+}
+
+// WithRootCAs sets the certificate authorities used to verify servers in the
+// tls and https modes and https:// proxies. By default the system pool is used.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *config) {
+		c.rootCAs = pool
+	}
+}
+
+// WithClientCertificate sets the certificate presented in tls mode to servers
+// that ask for one.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(c *config) {
+		c.clientCert = &cert
+	}
+}
+
+// WithCertWarning sets how close to expiry a certificate must be for a
+// successful tls check to carry a CERT_EXPIRING_SOON warning. It defaults to
+// 30 days.
+func WithCertWarning(d time.Duration) Option {
+	return func(c *config) {
+		c.certWarning = d
+	}
+}
+
+// WithLogger writes one structured access log entry per check to logger. By
+// default checks are logged as plain lines through the log package.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithCORSOrigins lets browser scripts served from origins, such as
+// https://dash.example.com, call the service. An origin of * allows any. CORS
+// is off by default.
+func WithCORSOrigins(origins []string) Option {
+	return func(c *config) {
+		c.corsOrigins = origins
+	}
+}
+
+// WithAllowlist restricts checks to targets matching entries, which are CIDR
+// blocks, IP addresses or host names that also match their subdomains.
+// Entries that fail to parse are ignored, so callers should validate them with
+// parseAllowlist first. With no entries every target is allowed.
+func WithAllowlist(entries []string) Option {
+	return func(c *config) {
+		if len(entries) == 0 {
+			c.allow = nil
+			return
+		}
+		var valid []string
+		for _, entry := range entries {
+			if _, err := parseAllowlist([]string{entry}); err == nil {
+				valid = append(valid, entry)
+			}
+		}
+		c.allow, _ = parseAllowlist(valid)
+	}
+}
+
+// WithDenyPrivate refuses targets, and proxies, that resolve to private,
+// loopback or link-local addresses. The address each connection is made to is
+// screened again as it is dialed, so a name resolving differently by then is
+// refused all the same.
+func WithDenyPrivate(deny bool) Option {
+	return func(c *config) {
+		c.denyPrivate = deny
+	}
+}
+
+// WithProxyFunc routes checks that name no proxy of their own through the
+// proxy f returns for an https:// request to the target, in the manner of
+// http.Transport.Proxy. A nil URL from f means the target is checked directly.
+// Only plain tcp checks are routed this way.
+func WithProxyFunc(f func(*http.Request) (*url.URL, error)) Option {
+	return func(c *config) {
+		c.proxyFunc = f
+	}
+}
+
+// WithProxyHeaders sets which headers of a proxy's CONNECT response are
+// reported in proxy_headers. It defaults to Via and X-Cache.
+func WithProxyHeaders(names []string) Option {
+	return func(c *config) {
+		c.proxyHeaders = nil
+		for _, name := range names {
+			if name = strings.TrimSpace(name); name != "" {
+				c.proxyHeaders = append(c.proxyHeaders, name)
+			}
+		}
+	}
+}
+
+// WithProxyPool keeps connections to http:// and https:// proxies that are
+// still usable after a check for up to idle, so later checks through the same
+// proxy can skip the dial. Pooling is off by default.
+func WithProxyPool(idle time.Duration) Option {
+	return func(c *config) {
+		c.proxyIdle = idle
+	}
+}
+
+// WithProxyTimeout bounds how long dialing a proxy may take, so a slow proxy
+// fails fast while the tunnel request keeps the whole check timeout. It has no
+// effect when longer than the check timeout, and 0, the default, leaves the
+// dial the whole check timeout.
+func WithProxyTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d >= 0 {
+			c.proxyTimeout = d
+		}
+	}
+}
+
+// WithProxyDrainLimit caps how many bytes of a proxy's CONNECT response body
+// are read and discarded. It defaults to 64KiB.
+func WithProxyDrainLimit(n int64) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.proxyDrain = n
+		}
+	}
+}
+
+// WithCacheTTL answers a check with the result of an identical one made up to
+// ttl earlier, marked cached. Checks are identical when their host, port,
+// proxy, mode, options and timeout all match. Caching is off by default;
+// identical checks made at the same time share one dial either way.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.cacheTTL = ttl
+	}
+}
+
+// WithDialKeepAlive sets the TCP keep-alive period of the connections checks
+// make, as net.Dialer.KeepAlive does: 0, the default, keeps the OS or Go
+// default of 15s and a negative period turns keep-alives off. Checks close
+// their connections at once, so this only matters for slow handshakes, where
+// a short period finds a dead peer sooner at the cost of more probe packets.
+func WithDialKeepAlive(d time.Duration) Option {
+	return func(c *config) {
+		c.keepAlive = d
+	}
+}
+
+// WithFallbackDelay sets how long a dial to a host name waits on its IPv6
+// addresses before racing an IPv4 one, as net.Dialer.FallbackDelay does: 0,
+// the default, waits 300ms and a negative delay turns the race off. A short
+// delay hides broken IPv6 sooner, at the cost of opening two connections
+// where one would do; a long one reports IPv6 trouble as slow checks. The
+// tcp and scan modes, which resolve the host themselves, race the addresses
+// they find the same way.
+func WithFallbackDelay(d time.Duration) Option {
+	return func(c *config) {
+		c.fallbackDelay = d
+	}
+}
+
+// WithDefaultMode sets the mode of the checks that do not give one with
+// ?mode=, in place of tcp; checks can still ask for any mode, tcp included.
+// The default applies over proto tcp only: udp and unix socket checks stay
+// in tcp mode. Through a proxy the default mode runs over the tunnel, so it
+// must be a mode that supports proxies, and checks that need what only tcp
+// mode does through a proxy, a proxy-http2 tunnel or a fallback chain, or
+// the proxy from the environment, must ask for tcp mode.
+func WithDefaultMode(mode string) Option {
+	return func(c *config) {
+		c.defaultMode = mode
+	}
+}
+
+// withDefaultMode returns t in the default mode when it names none.
+func (c config) withDefaultMode(t target) target {
+	if t.Mode == "" && (t.Proto == "" || t.Proto == "tcp") && c.defaultMode != "tcp" {
+		t.Mode = c.defaultMode
+	}
+	return t
+}
+
+// WithUserAgent sets the User-Agent of the requests the http, https, ws and
+// wss modes make and of the CONNECT requests sent to HTTP proxies. By default
+// the modes send Go's and CONNECTs send none.
+func WithUserAgent(ua string) Option {
+	return func(c *config) {
+		c.userAgent = ua
+	}
+}
+
+// WithRequestHeaders adds h to the requests the http, https, ws and wss modes
+// make and to the CONNECT requests sent to HTTP proxies, for endpoints and
+// proxies that gate on them. Headers a mode sets itself, such as the
+// WebSocket upgrade's, take precedence.
+func WithRequestHeaders(h http.Header) Option {
+	return func(c *config) {
+		c.header = h.Clone()
+	}
+}
+
+// headerFlag is a flag.Value collecting repeated "Name: Value" headers.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var lines []string
+	for name, values := range h {
+		for _, v := range values {
+			lines = append(lines, name+": "+v)
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, ", ")
+}
+
+func (h headerFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	switch {
+	case !ok || !httpguts.ValidHeaderFieldName(name):
+		return fmt.Errorf("%q is not a Name: Value header", v)
+	case !httpguts.ValidHeaderFieldValue(value):
+		return fmt.Errorf("header %s has an invalid value", name)
+	case strings.EqualFold(name, "Host"):
+		return errors.New("the Host header is set from the target")
+	}
+	http.Header(h).Add(name, value)
+	return nil
+}
+
+// requestHeader returns the headers WithUserAgent and WithRequestHeaders
+// add to outbound requests, in a copy the caller may change.
+func (c config) requestHeader() http.Header {
+	h := c.header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if c.userAgent != "" {
+		h.Set("User-Agent", c.userAgent)
+	}
+	return h
+}
+
+// dialer returns the dialer checks make their connections with, bounded by
+// timeout. With private addresses denied it refuses to connect to them.
+func (c config) dialer(timeout time.Duration) net.Dialer {
+	d := net.Dialer{
+		Timeout:       timeout,
+		KeepAlive:     c.keepAlive,
+		FallbackDelay: c.fallbackDelay,
+	}
+	if c.denyPrivate {
+		d.Control = publicOnly
+	}
+	return d
+}
+
+// WithTracerProvider records a span with tp for every check request, with
+// child spans for the dials and handshakes it makes. A nil provider, the
+// default, turns tracing off.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithToken requires check requests to present token as a bearer token. The
+// health, readiness, metrics, stats, version and modes endpoints and the
+// OpenAPI document stay open.
+func WithToken(token string) Option {
+	return func(c *config) {
+		c.token = token
+	}
+}
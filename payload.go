@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxPayload bounds the bytes ?send= may write and ?expect= may match.
+const maxPayload = 1024
+
+// decodePayload decodes the ?send= or ?expect= parameter called name. Payloads
+// are given in hex, two digits of either case per byte with nothing between
+// them, so 0d0a is a CRLF.
+func decodePayload(name, s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be hex encoded: %v", name, err)
+	}
+	if len(b) > maxPayload {
+		return nil, fmt.Errorf("%s is %d bytes; at most %d are allowed", name, len(b), maxPayload)
+	}
+	return b, nil
+}
+
+// checkPayload connects to host:port, writes send, if any, and reads until
+// the first len(expect) bytes of the reply are in, failing with
+// PAYLOAD_MISMATCH as soon as they differ from expect, or if the connection
+// closes or the timeout passes first. Received holds, in hex, what was read.
+func checkPayload(ctx context.Context, checker plainTest, host, port string, send, expect []byte) (int, result) {
+	c, latency, err := checker.Connect(ctx, host, port)
+	if err != nil {
+		code, status := http.StatusBadGateway, checker.phaseStatus(err)
+		if status == "HOST_CONNECT_TIMEOUT" || status == "CONNECT_TIMEOUT" {
+			code = http.StatusGatewayTimeout
+		}
+		return code, result{
+			Status: status,
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	defer c.Close()
+	if checker.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Now()) })
+	defer stop()
+	res := result{LatencyMS: millis(latency), RemoteAddr: c.RemoteAddr().String()}
+
+	_, s := startSpan(ctx, "payload", trace.SpanKindClient)
+	defer s.End()
+	if len(send) > 0 {
+		if _, err := c.Write(send); err != nil {
+			setSpanStatus(s, false, err.Error())
+			res.Status, res.Error, res.Code = "PAYLOAD_MISMATCH", "sending payload: "+err.Error(), errorCode(err)
+			res.err = err
+			return http.StatusBadGateway, res
+		}
+	}
+	got := make([]byte, 0, len(expect))
+	for len(got) < len(expect) {
+		n, err := c.Read(got[len(got):cap(got)])
+		got = got[:len(got)+n]
+		if !bytes.HasPrefix(expect, got) {
+			err = errors.New("reply does not match expect")
+		} else if err != nil && len(got) < len(expect) {
+			err = fmt.Errorf("reply ended after %d of %d expected bytes: %w", len(got), len(expect), err)
+		} else {
+			continue
+		}
+		setSpanStatus(s, false, err.Error())
+		res.Status, res.Error, res.Code = "PAYLOAD_MISMATCH", err.Error(), errorCode(err)
+		res.err = err
+		res.Received = hex.EncodeToString(got)
+		return http.StatusBadGateway, res
+	}
+	setSpanStatus(s, true, "")
+	res.Status = "OK"
+	res.Received = hex.EncodeToString(got)
+	return http.StatusOK, res
+}
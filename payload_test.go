@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// fakePingServer answers a PING line with +PONG, closes the connection on
+// QUIT and reads anything else without answering.
+func fakePingServer(t *testing.T) (string, func()) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch strings.TrimSpace(line) {
+					case "PING":
+						c.Write([]byte("+PONG\r\n"))
+					case "QUIT":
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestPayload(t *testing.T) {
+	addr, stop := fakePingServer(t)
+	defer stop()
+	svr := httptest.NewServer(Run(500 * time.Millisecond))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("match", func(t *testing.T) {
+		e.GET("/"+addr).
+			WithQuery("send", "50494e470d0a").
+			WithQuery("expect", "2B504F4E47").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("received", "2b504f4e47")
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		obj := e.GET("/"+addr).
+			WithQuery("send", "50494e470d0a").
+			WithQuery("expect", "2d4552520d0a").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "PAYLOAD_MISMATCH")
+		if got, _ := obj.Value("received").Raw().(string); !strings.HasPrefix(got, "2b") {
+			t.Errorf("received %q, want the start of +PONG", got)
+		}
+	})
+
+	t.Run("closed before the reply", func(t *testing.T) {
+		e.GET("/"+addr).
+			WithQuery("send", "515549540d0a").
+			WithQuery("expect", "2b4f4b").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "PAYLOAD_MISMATCH").
+			ValueEqual("code", "ERR_EOF").
+			NotContainsKey("received")
+	})
+
+	t.Run("no reply", func(t *testing.T) {
+		e.GET("/"+addr).
+			WithQuery("send", "4845590d0a").
+			WithQuery("expect", "2b").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "PAYLOAD_MISMATCH").
+			ValueEqual("code", "ERR_TIMEOUT")
+	})
+
+	t.Run("send only", func(t *testing.T) {
+		e.GET("/"+addr).
+			WithQuery("send", "50494e470d0a").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			NotContainsKey("received")
+	})
+
+	for _, c := range []struct {
+		name  string
+		query map[string]string
+	}{
+		{"not hex", map[string]string{"send": "PING"}},
+		{"odd length", map[string]string{"expect": "2b5"}},
+		{"too long", map[string]string{"send": strings.Repeat("00", maxPayload+1)}},
+		{"other mode", map[string]string{"send": "00", "mode": "tls"}},
+		{"udp", map[string]string{"send": "00", "proto": "udp"}},
+		{"proxy", map[string]string{"send": "00", "proxy": "http://127.0.0.1:1"}},
+		{"retries", map[string]string{"send": "00", "retries": "1"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := e.GET("/" + addr)
+			for k, v := range c.query {
+				req = req.WithQuery(k, v)
+			}
+			req.Expect().
+				Status(http.StatusBadRequest).
+				JSON().Object().
+				ValueEqual("status", "INVALID_PAYLOAD")
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pingSeq numbers echo requests so concurrent pings can tell their replies
+// apart on a shared raw socket.
+var pingSeq uint32
+
+// checkPing sends a single ICMP echo request to host and waits for the reply,
+// reporting the round trip as the latency. An unprivileged datagram socket is
+// used where the OS allows one, falling back to a raw socket; when neither
+// can be opened the check reports PING_UNSUPPORTED. The target's port plays
+// no part.
+func checkPing(ctx context.Context, checker plainTest, host string) (int, result) {
+	ips, err := checker.Resolve(ctx, host)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: checker.phaseStatus(err),
+			Error:  err.Error(),
+			Code:   errorCode(err),
+		}
+	}
+	ip, zone, _ := strings.Cut(ips[0], "%")
+	dst := net.ParseIP(ip)
+	is4 := dst.To4() != nil
+	if control := checker.Dialer.Control; control != nil {
+		// nothing is dialed, so the address is screened as a dial's would be
+		if err := control("ip", ips[0], nil); err != nil {
+			return http.StatusBadGateway, result{
+				Status: "HOST_CONNECT_FAIL",
+				Error:  err.Error(),
+				err:    err,
+			}
+		}
+	}
+
+	c, dgram, err := listenICMP(is4)
+	if err != nil {
+		return http.StatusNotImplemented, result{
+			Status: "PING_UNSUPPORTED",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			Note:   "the service may open neither an unprivileged icmp socket nor a raw one",
+		}
+	}
+	defer c.Close()
+
+	var addr net.Addr = &net.IPAddr{IP: dst, Zone: zone}
+	if dgram {
+		addr = &net.UDPAddr{IP: dst, Zone: zone}
+	}
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	proto := 1 // ICMP
+	if !is4 {
+		typ, proto = ipv6.ICMPTypeEchoRequest, 58 // ICMPv6
+	}
+	echo := &icmp.Echo{
+		ID:   os.Getpid() & 0xffff,
+		Seq:  int(atomic.AddUint32(&pingSeq, 1) & 0xffff),
+		Data: []byte("willitgo"),
+	}
+	msg, err := (&icmp.Message{Type: typ, Body: echo}).Marshal(nil)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+
+	if checker.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Now()) })
+	defer stop()
+
+	_, s := startSpan(ctx, "ping", trace.SpanKindClient)
+	s.SetAttributes(attribute.String("address", ips[0]))
+	defer s.End()
+	start := time.Now()
+	if _, err := c.WriteTo(msg, addr); err != nil {
+		setSpanStatus(s, false, err.Error())
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			setSpanStatus(s, false, err.Error())
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return http.StatusGatewayTimeout, result{
+					Status: "PING_TIMEOUT",
+					Error:  fmt.Sprintf("no echo reply from %s: %v", ips[0], err),
+					Code:   errorCode(err),
+				}
+			}
+			return http.StatusBadGateway, result{
+				Status: "HOST_CONNECT_FAIL",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+			}
+		}
+		rtt := time.Since(start)
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || !sameIP(from, dst) {
+			continue
+		}
+		// a raw socket sees every ICMP message the host receives, and the
+		// kernel rewrites the ID on datagram sockets, so replies are matched
+		// on the sequence number and payload alone
+		if r, ok := reply.Body.(*icmp.Echo); ok && r.Seq == echo.Seq && string(r.Data) == string(echo.Data) &&
+			(reply.Type == ipv4.ICMPTypeEchoReply || reply.Type == ipv6.ICMPTypeEchoReply) {
+			setSpanStatus(s, true, "")
+			family := "ip6"
+			if is4 {
+				family = "ip4"
+			}
+			return http.StatusOK, result{
+				Status:      "OK",
+				LatencyMS:   millis(rtt),
+				ResolvedIPs: ips,
+				Family:      family,
+				RemoteAddr:  ips[0],
+			}
+		}
+	}
+}
+
+// listenICMP opens an ICMP socket for the address family, preferring an
+// unprivileged datagram socket. dgram reports which kind was opened.
+func listenICMP(is4 bool) (c *icmp.PacketConn, dgram bool, err error) {
+	networks, addr := []string{"udp6", "ip6:ipv6-icmp"}, "::"
+	if is4 {
+		networks, addr = []string{"udp4", "ip4:icmp"}, "0.0.0.0"
+	}
+	for i, network := range networks {
+		if c, err = icmp.ListenPacket(network, addr); err == nil {
+			return c, i == 0, nil
+		}
+	}
+	return nil, false, err
+}
+
+// sameIP reports whether addr, as returned by a read from an ICMP socket, is
+// ip.
+func sameIP(addr net.Addr, ip net.IP) bool {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.Equal(ip)
+	case *net.UDPAddr:
+		return a.IP.Equal(ip)
+	}
+	return false
+}
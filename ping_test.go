@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestPingMode(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	res := e.GET("/127.0.0.1:1").
+		WithQuery("mode", "ping").
+		Expect()
+	obj := res.JSON().Object()
+	if obj.Value("status").Raw() == "PING_UNSUPPORTED" {
+		res.Status(http.StatusNotImplemented)
+		t.Skip("icmp sockets are not permitted here")
+	}
+	res.Status(http.StatusOK)
+	obj.ValueEqual("status", "OK").
+		ValueEqual("remote_addr", "127.0.0.1").
+		ValueEqual("family", "ip4").
+		ContainsKey("latency_ms")
+
+	t.Run("through a proxy", func(t *testing.T) {
+		e.GET("/127.0.0.1:1").
+			WithQuery("mode", "ping").
+			WithQuery("proxy", "127.0.0.1:3128").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_MODE")
+	})
+}
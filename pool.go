@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIdlePerProxy bounds the idle connections kept for any one proxy, and
+// maxPooledBody the size of an error response read to free a connection.
+const (
+	maxIdlePerProxy = 8
+	maxPooledBody   = 64 << 10
+)
+
+// proxyPool keeps idle connections to http:// and https:// proxies for reuse.
+// A successful CONNECT turns the connection into a tunnel that can never be
+// used again, so only connections whose CONNECT was answered with an error,
+// and that the proxy kept open, are returned to the pool. A nil pool keeps
+// nothing.
+type proxyPool struct {
+	ttl     time.Duration
+	metrics *metrics
+
+	mu   sync.Mutex
+	idle map[string][]idleConn
+}
+
+type idleConn struct {
+	conn  net.Conn
+	br    *bufio.Reader
+	since time.Time
+}
+
+// newProxyPool returns a pool keeping connections idle for at most ttl, or
+// nil when ttl is not positive.
+func newProxyPool(ttl time.Duration, m *metrics) *proxyPool {
+	if ttl <= 0 {
+		return nil
+	}
+	return &proxyPool{ttl: ttl, metrics: m, idle: map[string][]idleConn{}}
+}
+
+// get returns an idle connection to proxy, with the reader buffering it, or
+// nil if there is none.
+func (p *proxyPool) get(proxy string) (net.Conn, *bufio.Reader) {
+	if p == nil {
+		return nil, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[proxy]
+	for len(conns) > 0 {
+		ic := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(ic.since) < p.ttl && ic.alive() {
+			p.idle[proxy] = conns
+			p.metrics.poolHits.Inc()
+			return ic.conn, ic.br
+		}
+		ic.conn.Close()
+	}
+	delete(p.idle, proxy)
+	p.metrics.poolMisses.Inc()
+	return nil, nil
+}
+
+// put keeps c, read through br, for reuse with proxy, or closes it when the
+// pool is nil or full.
+func (p *proxyPool) put(proxy string, c net.Conn, br *bufio.Reader) {
+	if p == nil {
+		c.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[proxy]
+	// drop the connections that have idled too long, oldest first
+	for len(conns) > 0 && time.Since(conns[0].since) >= p.ttl {
+		conns[0].conn.Close()
+		conns = conns[1:]
+	}
+	if len(conns) >= maxIdlePerProxy {
+		conns[0].conn.Close()
+		conns = conns[1:]
+	}
+	p.idle[proxy] = append(conns, idleConn{conn: c, br: br, since: time.Now()})
+}
+
+// alive reports whether the proxy has left the connection open and silent.
+func (ic idleConn) alive() bool {
+	_ = ic.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := ic.br.Peek(1)
+	_ = ic.conn.SetReadDeadline(time.Time{})
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
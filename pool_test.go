@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// fakeKeepAliveProxy answers every CONNECT on a connection with status,
+// keeping the connection open after refusals as HTTP proxies do. It returns
+// the proxy address and a count of the connections accepted.
+func fakeKeepAliveProxy(t *testing.T, status int) (string, *int64, func()) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	var accepted int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					if _, err := http.ReadRequest(br); err != nil {
+						return
+					}
+					fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nContent-Length: 5\r\n\r\nnope\n", status, http.StatusText(status))
+					if status == http.StatusOK {
+						// the connection is a tunnel now
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), &accepted, func() { l.Close() }
+}
+
+func TestProxyPool(t *testing.T) {
+	t.Run("refused tunnels free the connection", func(t *testing.T) {
+		proxy, accepted, stop := fakeKeepAliveProxy(t, http.StatusForbidden)
+		defer stop()
+		svr := httptest.NewServer(Run(time.Second, WithProxyPool(time.Minute)))
+		defer svr.Close()
+		e := httpexpect.New(t, svr.URL)
+
+		e.GET("/example.com:443").
+			WithQuery("proxy", proxy).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			NotContainsKey("proxy_reused")
+		e.GET("/example.com:443").
+			WithQuery("proxy", proxy).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":       "PROXY_REFUSED",
+				"proxy_reused": true,
+			})
+		if n := atomic.LoadInt64(accepted); n != 1 {
+			t.Errorf("expected 1 proxy connection, got %d", n)
+		}
+
+		body := e.GET("/metrics").Expect().Status(http.StatusOK).Body()
+		body.Contains("willitgo_proxy_pool_hits_total 1\n")
+		body.Contains("willitgo_proxy_pool_misses_total 1\n")
+	})
+
+	t.Run("tunnels are never reused", func(t *testing.T) {
+		proxy, accepted, stop := fakeKeepAliveProxy(t, http.StatusOK)
+		defer stop()
+		svr := httptest.NewServer(Run(time.Second, WithProxyPool(time.Minute)))
+		defer svr.Close()
+		e := httpexpect.New(t, svr.URL)
+
+		for i := 0; i < 2; i++ {
+			e.GET("/example.com:443").
+				WithQuery("proxy", proxy).
+				Expect().
+				Status(http.StatusOK).
+				JSON().Object().
+				NotContainsKey("proxy_reused")
+		}
+		if n := atomic.LoadInt64(accepted); n != 2 {
+			t.Errorf("expected 2 proxy connections, got %d", n)
+		}
+	})
+
+	t.Run("idle connections expire", func(t *testing.T) {
+		proxy, accepted, stop := fakeKeepAliveProxy(t, http.StatusForbidden)
+		defer stop()
+		svr := httptest.NewServer(Run(time.Second, WithProxyPool(10*time.Millisecond)))
+		defer svr.Close()
+		e := httpexpect.New(t, svr.URL)
+
+		e.GET("/example.com:443").WithQuery("proxy", proxy).Expect().Status(http.StatusForbidden)
+		time.Sleep(20 * time.Millisecond)
+		e.GET("/example.com:443").
+			WithQuery("proxy", proxy).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			NotContainsKey("proxy_reused")
+		if n := atomic.LoadInt64(accepted); n != 2 {
+			t.Errorf("expected 2 proxy connections, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPortRange is the largest number of ports a single range check may span.
+const maxPortRange = 100
+
+type portResult struct {
+	Port   int    `json:"port"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// parsePortRange parses a start-end port range such as 8000-8010.
+func parsePortRange(s string) (first, last int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("port range %q must look like start-end", s)
+	}
+	if first, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid start of port range %q", s)
+	}
+	if last, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, fmt.Errorf("invalid end of port range %q", s)
+	}
+	switch {
+	case first < 1 || last > 65535:
+		return 0, 0, fmt.Errorf("port range %q must be within 1-65535", s)
+	case first > last:
+		return 0, 0, fmt.Errorf("port range %q is inverted", s)
+	case last-first+1 > maxPortRange:
+		return 0, 0, fmt.Errorf("port range %q spans more than %d ports", s, maxPortRange)
+	}
+	return first, last, nil
+}
+
+// checkPortRange checks t on every port from first to last, running the
+// checks with the batch worker pool.
+func checkPortRange(ctx context.Context, cfg config, timeout time.Duration, t target, first, last int) []portResult {
+	targets := make([]target, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		t.Port = strconv.Itoa(port)
+		targets = append(targets, t)
+	}
+	results, _ := runBatch(ctx, cfg, targets, timeout)
+	out := make([]portResult, len(results))
+	for i, res := range results {
+		out[i] = portResult{
+			Port:   first + i,
+			Status: res.Status,
+			Error:  res.Error,
+		}
+	}
+	return out
+}
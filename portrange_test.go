@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestPortRange(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, open, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(open)
+	portRange := strconv.Itoa(port) + "-" + strconv.Itoa(port+2)
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("per port results", func(t *testing.T) {
+		results := e.GET("/127.0.0.1:" + portRange).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Array()
+		results.Length().Equal(3)
+		results.Element(0).Object().
+			ValueEqual("port", port).
+			ValueEqual("status", "OK")
+		results.Element(1).Object().ValueEqual("port", port+1)
+		results.Element(2).Object().ValueEqual("port", port+2)
+	})
+
+	for _, portRange := range []string{"8010-8000", "1-1000", "0-10", "80-http"} {
+		t.Run("rejects "+portRange, func(t *testing.T) {
+			e.GET("/127.0.0.1:"+portRange).
+				Expect().
+				Status(http.StatusBadRequest).
+				JSON().Object().
+				ValueEqual("status", "INVALID_PORT_RANGE")
+		})
+	}
+}
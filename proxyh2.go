@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// connectHTTP2 asks the proxy at proxyURL for a tunnel to host:port with an
+// HTTP/2 CONNECT request, over TLS for https:// proxies and with prior
+// knowledge for http:// ones. The result and error are as for connect.
+func (p proxyHandler) connectHTTP2(ctx context.Context, proxy string, proxyURL *url.URL, host, port string) (result, error) {
+	protocols := new(http.Protocols)
+	if proxyURL.Scheme == "https" {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	// the transport may still be dialing after a timed out request returns,
+	// so everything the dialer records is guarded by mu
+	var mu sync.Mutex
+	var latency time.Duration
+	var dialErr error
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: p.dialTimeout(), KeepAlive: 0, Control: p.Control}
+			_, s := startSpan(ctx, "proxy dial", trace.SpanKindClient)
+			s.SetAttributes(attribute.String("address", addr))
+			defer s.End()
+			start := time.Now()
+			c, err := dialer.DialContext(ctx, network, addr)
+			setSpanStatus(s, err == nil, fmt.Sprint(err))
+			mu.Lock()
+			defer mu.Unlock()
+			latency, dialErr = time.Since(start), err
+			return c, err
+		},
+		TLSClientConfig: &tls.Config{RootCAs: p.RootCAs},
+		Protocols:       protocols,
+	}
+	defer tr.CloseIdleConnections()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	// the request body is the client's half of the tunnel, held open until
+	// the proxy has answered
+	body, hold := io.Pipe()
+	defer hold.Close()
+	target := net.JoinHostPort(host, port)
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: proxyURL.Scheme, Host: proxyURL.Host},
+		Host:   target,
+		Header: p.RequestHeader.Clone(),
+		Body:   body,
+	}).WithContext(ctx)
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+
+	_, s := startSpan(ctx, "proxy connect", trace.SpanKindClient)
+	s.SetAttributes(
+		attribute.String("scheme", proxyURL.Scheme),
+		attribute.String("target", target),
+		attribute.Bool("http2", true),
+	)
+	defer s.End()
+	start := time.Now()
+	res, err := tr.RoundTrip(req)
+	mu.Lock()
+	reslt := result{
+		Status:    "OK",
+		Proxy:     proxy,
+		LatencyMS: millis(latency),
+		ConnectMS: millis(time.Since(start) - latency),
+	}
+	dialed := dialErr
+	mu.Unlock()
+	if err != nil {
+		setSpanStatus(s, false, err.Error())
+		reslt.Error = err.Error()
+		reslt.Code = errorCode(err)
+		var certErr *tls.CertificateVerificationError
+		var tlsErr tls.AlertError
+		var recordErr tls.RecordHeaderError
+		switch {
+		case dialed != nil:
+			reslt.Status, reslt.Error = "PROXY_UNREACHABLE", dialed.Error()
+			reslt.Code = errorCode(dialed)
+			return reslt, &proxyError{http.StatusBadRequest, dialed}
+		case errors.As(err, &certErr), errors.As(err, &tlsErr), errors.As(err, &recordErr):
+			reslt.Status = "PROXY_TLS_FAIL"
+			return reslt, &proxyError{http.StatusBadGateway, err}
+		}
+		reslt.Status = "PROXY_CONNECT_ERROR"
+		code := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			code = http.StatusGatewayTimeout
+		}
+		return reslt, &proxyError{code, err}
+	}
+	defer res.Body.Close()
+
+	for _, name := range p.Headers {
+		if values := res.Header.Values(name); len(values) > 0 {
+			if reslt.ProxyHeaders == nil {
+				reslt.ProxyHeaders = map[string]string{}
+			}
+			reslt.ProxyHeaders[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+		}
+	}
+	s.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		reslt.ProxyStatusText = reasonPhrase(res)
+	}
+	switch {
+	case res.StatusCode == http.StatusProxyAuthRequired:
+		reslt.Status = "PROXY_AUTH_REQUIRED"
+		reslt.Error = res.Status
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		reslt.Status = "PROXY_REFUSED"
+		reslt.Error = fmt.Sprintf("proxy answered CONNECT with %d", res.StatusCode)
+	default:
+		setSpanStatus(s, true, "")
+		return reslt, nil
+	}
+	setSpanStatus(s, false, reslt.Error)
+	return reslt, &proxyError{res.StatusCode, errors.New(reslt.Error)}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// h2Proxy opens tunnels to any target but forbidden.example.com.
+var h2Proxy = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Host == "forbidden.example.com:443" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Via", "2 h2proxy")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	io.Copy(io.Discard, r.Body)
+})
+
+func TestProxyHTTP2(t *testing.T) {
+	h2c := httptest.NewUnstartedServer(h2Proxy)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	h2 := httptest.NewUnstartedServer(h2Proxy)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(h2.Certificate())
+	svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("cleartext", func(t *testing.T) {
+		e.GET("/example.com:443").
+			WithQuery("proxy", h2c.Listener.Addr().String()).
+			WithQuery("proxy-http2", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":        "OK",
+				"proxy_headers": map[string]interface{}{"Via": "2 h2proxy"},
+			})
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		e.GET("/example.com:443").
+			WithQuery("proxy", "https://"+h2.Listener.Addr().String()).
+			WithQuery("proxy-http2", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		e.GET("/forbidden.example.com:443").
+			WithQuery("proxy", h2c.Listener.Addr().String()).
+			WithQuery("proxy-http2", "true").
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "PROXY_REFUSED")
+	})
+
+	t.Run("http/1 only proxy", func(t *testing.T) {
+		proxy, _, stop := fakeKeepAliveProxy(t, http.StatusOK)
+		defer stop()
+		e.GET("/example.com:443").
+			WithQuery("proxy", proxy).
+			WithQuery("proxy-http2", "true").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "PROXY_CONNECT_ERROR")
+	})
+
+	t.Run("socks proxy", func(t *testing.T) {
+		e.GET("/example.com:443").
+			WithQuery("proxy", "socks5://127.0.0.1:1080").
+			WithQuery("proxy-http2", "true").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_PROXY")
+	})
+
+	t.Run("no proxy", func(t *testing.T) {
+		e.GET("/example.com:443").
+			WithQuery("proxy-http2", "true").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_PROXY")
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// proxyProtocolProbe bounds how long a plain check waits, after sending a
+// PROXY protocol header, for the backend to hang up on it.
+const proxyProtocolProbe = 200 * time.Millisecond
+
+// errProxyProtocolRejected reports a backend that closed the connection
+// after reading the PROXY protocol header.
+var errProxyProtocolRejected = errors.New("connection closed after the PROXY protocol header")
+
+// proxyProtocolV2Sig opens every version 2 PROXY protocol header.
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeader builds the version v1 or v2 PROXY protocol header
+// announcing a TCP connection from src to dst.
+func proxyProtocolHeader(version string, src, dst net.Addr) ([]byte, error) {
+	from, ok1 := src.(*net.TCPAddr)
+	to, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("PROXY protocol header needs TCP addresses, not %s", src.Network())
+	}
+	fromIP, toIP := from.IP.To4(), to.IP.To4()
+	family := "TCP4"
+	if fromIP == nil || toIP == nil {
+		fromIP, toIP, family = from.IP.To16(), to.IP.To16(), "TCP6"
+	}
+	switch version {
+	case "v1":
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, from.IP, to.IP, from.Port, to.Port)), nil
+	case "v2":
+		h := append([]byte{}, proxyProtocolV2Sig...)
+		// version 2, PROXY command; then TCP over IPv4 or IPv6
+		h = append(h, 0x21, 0x11)
+		if family == "TCP6" {
+			h[len(h)-1] = 0x21
+		}
+		h = binary.BigEndian.AppendUint16(h, uint16(2*len(fromIP)+4))
+		h = append(h, fromIP...)
+		h = append(h, toIP...)
+		h = binary.BigEndian.AppendUint16(h, uint16(from.Port))
+		h = binary.BigEndian.AppendUint16(h, uint16(to.Port))
+		return h, nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+// sendProxyProtocol writes the version v PROXY protocol header for c to c.
+func sendProxyProtocol(c net.Conn, version string) error {
+	h, err := proxyProtocolHeader(version, c.LocalAddr(), c.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(h)
+	return err
+}
+
+// proxyProtocolAccepted waits briefly after the header has been sent on c,
+// failing with errProxyProtocolRejected if the backend hangs up. Silence or
+// data both mean the backend kept the connection.
+func proxyProtocolAccepted(c net.Conn) error {
+	_ = c.SetReadDeadline(time.Now().Add(proxyProtocolProbe))
+	_, err := c.Read(make([]byte, 1))
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", errProxyProtocolRejected, err)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	for _, c := range []struct {
+		version  string
+		src, dst net.Addr
+		exp      string
+	}{
+		{"v1", v4src, v4dst, "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n"},
+		{"v1", v6src, v6dst, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{"v2", v4src, v4dst, "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01\xc6\x33\x64\x07\xdc\x04\x01\xbb"},
+	} {
+		got, err := proxyProtocolHeader(c.version, c.src, c.dst)
+		if err != nil || !reflect.DeepEqual(c.exp, string(got)) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d:\n\n\texp: %q\n\n\tgot: %q (%v)\n\n", file, line, c.exp, got, err)
+			t.Fail()
+		}
+	}
+	h, err := proxyProtocolHeader("v2", v6src, v6dst)
+	if err != nil || len(h) != 16+36 || h[13] != 0x21 {
+		t.Errorf("unexpected v2 header for IPv6: %q (%v)", h, err)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	// The backend keeps connections that open with a v1 header and hangs up
+	// on the rest.
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	headers := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(time.Second))
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err != nil || !strings.HasPrefix(line, "PROXY ") {
+					return
+				}
+				headers <- line
+				c.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	e.GET("/"+l.Addr().String()).
+		WithQuery("proxy-protocol", "v1").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "OK")
+	header := <-headers
+	if !strings.HasPrefix(header, "PROXY TCP4 127.0.0.1 127.0.0.1 ") || !strings.HasSuffix(header, " "+strings.Split(l.Addr().String(), ":")[1]+"\r\n") {
+		t.Errorf("unexpected header %q", header)
+	}
+
+	e.GET("/"+l.Addr().String()).
+		WithQuery("proxy-protocol", "v2").
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		ValueEqual("status", "PROXY_PROTOCOL_REJECTED")
+
+	e.GET("/"+l.Addr().String()).
+		WithQuery("proxy-protocol", "v3").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "INVALID_PROXY_PROTOCOL")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyTestHandler serves GET /proxytest/host:port?proxies=a,b,c, checking
+// the target through each proxy and answering with their results in the
+// order the proxies were given. It is the inverse of /batch: one target,
+// many proxies, checked at most cfg.batchWorkers at a time.
+func proxyTestHandler(timeout time.Duration, cfg config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, err := requestTimeout(r, timeout, cfg.maxTimeout)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "INVALID_TIMEOUT",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+			})
+			return
+		}
+		host, port, err := parseTarget(strings.TrimPrefix(r.URL.Path, "/proxytest/"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "INVALID_HOST",
+				Target: strings.TrimPrefix(r.URL.Path, "/proxytest/"),
+				Error:  err.Error(),
+				Code:   errorCode(err),
+			})
+			return
+		}
+		var targets []target
+		for _, proxy := range strings.Split(r.URL.Query().Get("proxies"), ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				targets = append(targets, target{Host: host, Port: port, Proxy: proxy})
+			}
+		}
+		if len(targets) == 0 {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "MISSING_PROXIES",
+				Error:  "list the proxies to test in ?proxies=, separated by commas",
+			})
+			return
+		}
+		results, _ := runBatch(r.Context(), cfg, targets, timeout)
+		writeJSON(w, http.StatusOK, results)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestProxyTest(t *testing.T) {
+	ok, _, stopOK := fakeKeepAliveProxy(t, http.StatusOK)
+	defer stopOK()
+	refusing, _, stopRefusing := fakeKeepAliveProxy(t, http.StatusForbidden)
+	defer stopRefusing()
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	down := l.Addr().String()
+	l.Close()
+
+	svr := httptest.NewServer(Run(time.Second, WithBatchWorkers(2)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("results in order", func(t *testing.T) {
+		results := e.GET("/proxytest/example.com:443").
+			WithQuery("proxies", ok+","+refusing+", "+down+",").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Array()
+		results.Length().Equal(3)
+		results.Element(0).Object().ContainsMap(map[string]interface{}{
+			"status": "OK",
+			"proxy":  ok,
+		})
+		results.Element(0).Object().ContainsKey("latency_ms")
+		results.Element(1).Object().ContainsMap(map[string]interface{}{
+			"status": "PROXY_REFUSED",
+			"proxy":  refusing,
+		})
+		results.Element(2).Object().ContainsMap(map[string]interface{}{
+			"status": "PROXY_UNREACHABLE",
+			"proxy":  down,
+		})
+	})
+
+	t.Run("missing proxies", func(t *testing.T) {
+		e.GET("/proxytest/example.com:443").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "MISSING_PROXIES")
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		e.GET("/proxytest/example.com").
+			WithQuery("proxies", ok).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_HOST")
+	})
+}
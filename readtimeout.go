@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readTimeoutError is the error of a read that waited longer than
+// ?read-timeout= for data. It wraps the timeout the read failed with.
+type readTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *readTimeoutError) Error() string {
+	return fmt.Sprintf("read timeout: no data for %v", e.timeout)
+}
+
+func (e *readTimeoutError) Unwrap() error   { return e.err }
+func (e *readTimeoutError) Timeout() bool   { return true }
+func (e *readTimeoutError) Temporary() bool { return true }
+
+// readTimeoutConn is a net.Conn each of whose reads fails with a
+// readTimeoutError once no data has arrived for timeout, so that a server
+// that accepts the connection but never answers is given up on before the
+// check timeout. The deadlines set on it still apply: a read ends at
+// whichever comes first.
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+
+	// mu orders the deadlines Read sets against those set by others, such
+	// as a check abandoned when its request is canceled
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// idle returns c with reads bounded by t.ReadTimeout, or c itself when that
+// is not set.
+func (t plainTest) idle(c net.Conn) net.Conn {
+	if t.ReadTimeout <= 0 || c == nil {
+		return c
+	}
+	return &readTimeoutConn{Conn: c, timeout: t.ReadTimeout}
+}
+
+func (c *readTimeoutConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *readTimeoutConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *readTimeoutConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	idle := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(idle) {
+		idle = time.Time{}
+		_ = c.Conn.SetReadDeadline(c.deadline)
+	} else {
+		_ = c.Conn.SetReadDeadline(idle)
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(b)
+	var netErr net.Error
+	if err != nil && !idle.IsZero() && !time.Now().Before(idle) && errors.As(err, &netErr) && netErr.Timeout() {
+		err = &readTimeoutError{timeout: c.timeout, err: err}
+	}
+	return n, err
+}
+
+// readTimedOut reports a check that failed because a read outlasted
+// ?read-timeout= as READ_TIMEOUT, whatever status its mode gave it.
+func readTimedOut(code int, res result) (int, result) {
+	if res.Code != "ERR_READ_TIMEOUT" {
+		return code, res
+	}
+	res.Status = "READ_TIMEOUT"
+	return http.StatusGatewayTimeout, res
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestReadTimeout(t *testing.T) {
+	// accepts connections and never writes to them
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	silent := l.Addr().String()
+
+	svr := httptest.NewServer(Run(5 * time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	for _, q := range []map[string]string{
+		{"mode": "ssh"},
+		{"mode": "smtp"},
+		{"mode": "tls"},
+		{"send": "00", "expect": "2b"},
+	} {
+		start := time.Now()
+		req := e.GET("/"+silent).WithQuery("read-timeout", "100ms")
+		for k, v := range q {
+			req = req.WithQuery(k, v)
+		}
+		req.Expect().
+			Status(http.StatusGatewayTimeout).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "READ_TIMEOUT",
+				"code":   "ERR_READ_TIMEOUT",
+			})
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%v: took %v, waiting out the check timeout", q, elapsed)
+		}
+	}
+
+	// the check timeout still applies when it is the shorter
+	e.GET("/"+silent).
+		WithQuery("mode", "ssh").
+		WithQuery("timeout", "100ms").
+		WithQuery("read-timeout", "2s").
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status": "SSH_BANNER_FAIL",
+			"code":   "ERR_TIMEOUT",
+		})
+
+	for _, v := range []string{"soon", "0s", "-1s"} {
+		e.GET("/"+silent).
+			WithQuery("mode", "ssh").
+			WithQuery("read-timeout", v).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_TIMEOUT")
+	}
+}
+
+func TestReadTimeoutConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := plainTest{ReadTimeout: 50 * time.Millisecond}.idle(client)
+	defer c.Close()
+
+	// data arriving within the read timeout resets it
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(30 * time.Millisecond)
+			server.Write([]byte{byte(i)})
+		}
+	}()
+	var got []byte
+	b := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b[0])
+	}
+	if exp := []byte{0, 1, 2}; !reflect.DeepEqual(exp, got) {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, exp, got)
+		t.Fail()
+	}
+
+	var readErr *readTimeoutError
+	if _, err := c.Read(b); !errors.As(err, &readErr) {
+		t.Errorf("expected a read timeout once no data came, got %v", err)
+	}
+
+	// an earlier deadline ends the read as a plain timeout
+	c.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := c.Read(b)
+	var netErr net.Error
+	if errors.As(err, &readErr) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected the deadline to end the read, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyHandler serves /readyz. It answers 200 READY when the service can
+// reach the world, shown by dialing cfg.canary, and 503 NOT_READY with the
+// dial error otherwise. Without a canary it is as ready as it is alive.
+func readyHandler(timeout time.Duration, cfg config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.canary == "" {
+			writeJSON(w, http.StatusOK, result{Status: "READY"})
+			return
+		}
+		host, port, err := parseTarget(cfg.canary)
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, result{
+				Status: "NOT_READY",
+				Error:  fmt.Sprintf("canary %q: %v", cfg.canary, err),
+			})
+			return
+		}
+		checker := plainTest{Dialer: cfg.dialer(timeout)}
+		d, err := checker.Check(r.Context(), host, port)
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, result{
+				Status: "NOT_READY",
+				Error:  fmt.Sprintf("canary %s: %v", cfg.canary, err),
+				Code:   errorCode(err),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, result{
+			Status:    "READY",
+			LatencyMS: millis(d.Latency),
+		})
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestReady(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	down, _ := net.Listen("tcp", "127.0.0.1:")
+	down.Close()
+
+	t.Run("canary reachable", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second, WithCanary(l.Addr().String()), WithToken("s3cret")))
+		defer svr.Close()
+		httpexpect.New(t, svr.URL).
+			GET("/readyz").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "READY").
+			ContainsKey("latency_ms")
+	})
+
+	t.Run("canary unreachable", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second, WithCanary(down.Addr().String())))
+		defer svr.Close()
+		httpexpect.New(t, svr.URL).
+			GET("/readyz").
+			Expect().
+			Status(http.StatusServiceUnavailable).
+			JSON().Object().
+			ValueEqual("status", "NOT_READY").
+			Value("error").String().Contains(down.Addr().String())
+	})
+
+	t.Run("no canary", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second))
+		defer svr.Close()
+		httpexpect.New(t, svr.URL).
+			GET("/readyz").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "READY")
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// smtpHelo is the name checkSMTP introduces itself with.
+const smtpHelo = "willitgo"
+
+// checkSMTP connects to host:port and reads the server's greeting, failing
+// with SMTP_BANNER_FAIL unless a 220 arrives within the timeout. With ehlo set
+// it also says EHLO and reports whether the server offers STARTTLS, before
+// saying QUIT.
+func checkSMTP(ctx context.Context, checker plainTest, host, port string, ehlo bool) (int, result) {
+	c, latency, err := checker.Connect(ctx, host, port)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	defer c.Close()
+	if checker.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+	}
+	res := result{LatencyMS: millis(latency)}
+
+	_, s := startSpan(ctx, "smtp", trace.SpanKindClient)
+	defer s.End()
+	tc := textproto.NewConn(c)
+	code, msg, err := tc.ReadResponse(220)
+	res.SMTPCode = code
+	res.Banner = firstLine(msg)
+	if err != nil {
+		setSpanStatus(s, false, err.Error())
+		res.Status, res.Error, res.Code = "SMTP_BANNER_FAIL", err.Error(), errorCode(err)
+		return http.StatusBadGateway, res
+	}
+	if ehlo {
+		id, err := tc.Cmd("EHLO %s", smtpHelo)
+		if err == nil {
+			tc.StartResponse(id)
+			code, msg, err = tc.ReadResponse(250)
+			tc.EndResponse(id)
+		}
+		if err != nil {
+			setSpanStatus(s, false, err.Error())
+			res.Status, res.Error, res.Code = "SMTP_EHLO_FAIL", err.Error(), errorCode(err)
+			return http.StatusBadGateway, res
+		}
+		res.SMTPCode = code
+		starttls := false
+		for _, ext := range strings.Split(msg, "\n") {
+			if strings.EqualFold(strings.TrimSpace(ext), "STARTTLS") {
+				starttls = true
+			}
+		}
+		res.StartTLS = &starttls
+	}
+	tc.PrintfLine("QUIT")
+	setSpanStatus(s, true, "")
+	res.Status = "OK"
+	return http.StatusOK, res
+}
+
+// firstLine returns s up to its first line break.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
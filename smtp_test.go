@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// fakeSMTP greets each client with greeting, or stays silent when it is
+// empty, and answers EHLO with the extensions given.
+func fakeSMTP(t *testing.T, greeting string, extensions ...string) (string, func()) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if greeting == "" {
+					io.Copy(io.Discard, c)
+					return
+				}
+				io.WriteString(c, greeting+"\r\n")
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch {
+					case strings.HasPrefix(line, "EHLO "):
+						lines := append([]string{"mail.example.com"}, extensions...)
+						for i, l := range lines {
+							sep := "-"
+							if i == len(lines)-1 {
+								sep = " "
+							}
+							io.WriteString(c, "250"+sep+l+"\r\n")
+						}
+					case strings.HasPrefix(line, "QUIT"):
+						io.WriteString(c, "221 bye\r\n")
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestSMTPMode(t *testing.T) {
+	tlsMail, stop := fakeSMTP(t, "220 mail.example.com ESMTP ready", "PIPELINING", "STARTTLS")
+	defer stop()
+	plainMail, stop := fakeSMTP(t, "220 old.example.com ESMTP", "PIPELINING")
+	defer stop()
+	busy, stop := fakeSMTP(t, "554 no service")
+	defer stop()
+	silent, stop := fakeSMTP(t, "")
+	defer stop()
+
+	svr := httptest.NewServer(Run(200 * time.Millisecond))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("banner", func(t *testing.T) {
+		obj := e.GET("/"+tlsMail).
+			WithQuery("mode", "smtp").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ContainsMap(map[string]interface{}{
+			"status":    "OK",
+			"smtp_code": 220,
+			"banner":    "mail.example.com ESMTP ready",
+		})
+		obj.NotContainsKey("starttls")
+	})
+
+	t.Run("ehlo", func(t *testing.T) {
+		e.GET("/"+tlsMail).
+			WithQuery("mode", "smtp").
+			WithQuery("probe", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":    "OK",
+				"smtp_code": 250,
+				"starttls":  true,
+			})
+		e.GET("/"+plainMail).
+			WithQuery("mode", "smtp").
+			WithQuery("probe", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("starttls", false)
+	})
+
+	t.Run("refused service", func(t *testing.T) {
+		e.GET("/"+busy).
+			WithQuery("mode", "smtp").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":    "SMTP_BANNER_FAIL",
+				"smtp_code": 554,
+			})
+	})
+
+	t.Run("no banner", func(t *testing.T) {
+		e.GET("/"+silent).
+			WithQuery("mode", "smtp").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "SMTP_BANNER_FAIL",
+				"code":   "ERR_TIMEOUT",
+			})
+	})
+}
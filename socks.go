@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version    = 0x04
+	socks4Granted    = 0x5a
+	socks5Version    = 0x05
+	socks5NoAuth     = 0x00
+	socksCmdConnect  = 0x01
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+var socks4Replies = map[byte]string{
+	0x5b: "request rejected or failed",
+	0x5c: "request rejected: proxy cannot reach client identd",
+	0x5d: "request rejected: identd user mismatch",
+}
+
+// socks4Connect performs the SOCKS4 CONNECT handshake over rw, asking the
+// proxy to open a tunnel to host:port. SOCKS4 only carries IPv4 addresses, so
+// host names are resolved locally, within ctx; with remoteDNS set the SOCKS4a
+// extension is used instead and the proxy resolves the name.
+func socks4Connect(ctx context.Context, rw io.ReadWriter, host, port, user string, remoteDNS bool) error {
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks4: invalid port %q", port)
+	}
+
+	req := []byte{socks4Version, socksCmdConnect, byte(portnum >> 8), byte(portnum)}
+	ip := net.ParseIP(host)
+	if ip == nil && !remoteDNS {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				ip = addr.IP
+				break
+			}
+		}
+		if ip == nil {
+			return fmt.Errorf("socks4: no IPv4 address for %q", host)
+		}
+	}
+	switch {
+	case ip == nil:
+		// 0.0.0.x tells a SOCKS4a proxy that a host name follows
+		req = append(req, 0, 0, 0, 1)
+	case ip.To4() != nil:
+		req = append(req, ip.To4()...)
+	default:
+		return fmt.Errorf("socks4: IPv6 address %q is not supported", host)
+	}
+	req = append(req, user...)
+	req = append(req, 0)
+	if ip == nil {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+
+	var reply [8]byte
+	if _, err := io.ReadFull(rw, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socks4Granted {
+		if msg, ok := socks4Replies[reply[1]]; ok {
+			return fmt.Errorf("socks4: %s", msg)
+		}
+		return fmt.Errorf("socks4: unknown reply code %d", reply[1])
+	}
+	return nil
+}
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Connect performs the SOCKS5 greeting and CONNECT handshake (RFC 1928)
+// over rw, asking the proxy to open a tunnel to host:port.
+func socks5Connect(rw io.ReadWriter, host, port string) error {
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks5: invalid port %q", port)
+	}
+
+	if _, err := rw.Write([]byte{socks5Version, 1, socks5NoAuth}); err != nil {
+		return err
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(rw, greeting[:]); err != nil {
+		return err
+	}
+	if greeting[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", greeting[0])
+	}
+	if greeting[1] != socks5NoAuth {
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	req := []byte{socks5Version, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: host name too long %q", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(portnum>>8), byte(portnum))
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(rw, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", reply[0])
+	}
+	if reply[1] != 0 {
+		if msg, ok := socks5Replies[reply[1]]; ok {
+			return fmt.Errorf("socks5: %s", msg)
+		}
+		return fmt.Errorf("socks5: unknown reply code %d", reply[1])
+	}
+
+	// drain the bound address so the tunnel starts clean
+	var skip int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(rw, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", reply[3])
+	}
+	_, err = io.ReadFull(rw, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// fakeSocks5 accepts a single client, completes the no-auth greeting, reads
+// the CONNECT request and answers with the given reply code.
+func fakeSocks5(reply byte) (addr string, requests <-chan []byte) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	ch := make(chan []byte, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		greeting := make([]byte, 3)
+		io.ReadFull(c, greeting)
+		c.Write([]byte{5, 0})
+		head := make([]byte, 5)
+		io.ReadFull(c, head)
+		rest := make([]byte, int(head[4])+2)
+		io.ReadFull(c, rest)
+		ch <- append(head, rest...)
+		c.Write([]byte{5, reply, 0, 1, 127, 0, 0, 1, 0, 80})
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestSocks5Connect(t *testing.T) {
+	proxyAddr, requests := fakeSocks5(0)
+
+	var handler http.Handler = proxyHandler{Timeout: 1 * time.Second}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/google.com:80", nil)
+	req.URL.RawQuery = url.Values{
+		"proxy": {"socks5://" + proxyAddr},
+	}.Encode()
+
+	handler.ServeHTTP(res, req)
+	expected := append([]byte{5, 1, 0, 3, byte(len("google.com"))}, "google.com\x00\x50"...)
+	actual := <-requests
+	if !reflect.DeepEqual(expected, actual) {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, expected, actual)
+		t.FailNow()
+	}
+	if http.StatusOK != res.Code {
+		_, file, line, _ := runtime.Caller(0)
+		t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, http.StatusOK, res.Code)
+		t.FailNow()
+	}
+}
+
+func TestSocks5Server(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("connect via socks5", func(t *testing.T) {
+		proxyAddr, _ := fakeSocks5(0)
+		e.GET("/google.com:80").
+			WithQuery("proxy", "socks5://"+proxyAddr).
+			Expect().
+			StatusRange(httpexpect.Status2xx).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "OK",
+				"proxy":  "socks5://" + proxyAddr,
+			})
+	})
+
+	t.Run("socks5 refuses", func(t *testing.T) {
+		proxyAddr, _ := fakeSocks5(5)
+		e.GET("/google.com:80").
+			WithQuery("proxy", "socks5://"+proxyAddr).
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "PROXY_CONNECT_ERROR",
+				"error":  "socks5: connection refused",
+			})
+	})
+
+	t.Run("socks5 unreachable", func(t *testing.T) {
+		e.GET("/google.com:80").
+			WithQuery("proxy", "socks5://127.0.0.1:1").
+			Expect().
+			StatusRange(httpexpect.Status4xx).
+			JSON().Object().
+			ValueEqual("status", "PROXY_UNREACHABLE")
+	})
+}
+
+// fakeSocks4 accepts a single client, reads a SOCKS4 or SOCKS4a CONNECT
+// request and answers with the given reply code.
+func fakeSocks4(reply byte) (addr string, requests <-chan []byte) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	ch := make(chan []byte, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		r := bufio.NewReader(c)
+		req := make([]byte, 8)
+		io.ReadFull(r, req)
+		user, _ := r.ReadBytes(0)
+		req = append(req, user...)
+		if req[4] == 0 && req[5] == 0 && req[6] == 0 && req[7] != 0 {
+			host, _ := r.ReadBytes(0)
+			req = append(req, host...)
+		}
+		ch <- req
+		c.Write([]byte{0, reply, 0, 0, 0, 0, 0, 0})
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestSocks4Connect(t *testing.T) {
+	for _, tc := range []struct {
+		proxy    string
+		target   string
+		expected []byte
+	}{
+		{"socks4://", "/127.0.0.1:80", []byte{4, 1, 0, 80, 127, 0, 0, 1, 0}},
+		{"socks4://alice@", "/127.0.0.1:80", append([]byte{4, 1, 0, 80, 127, 0, 0, 1}, "alice\x00"...)},
+		{"socks4://", "/localhost:80", []byte{4, 1, 0, 80, 127, 0, 0, 1, 0}},
+		{"socks4a://", "/example.com:443", append([]byte{4, 1, 1, 187, 0, 0, 0, 1, 0}, "example.com\x00"...)},
+	} {
+		proxyAddr, requests := fakeSocks4(0x5a)
+
+		var handler http.Handler = proxyHandler{Timeout: 1 * time.Second}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tc.target, nil)
+		req.URL.RawQuery = url.Values{
+			"proxy": {tc.proxy + proxyAddr},
+		}.Encode()
+
+		handler.ServeHTTP(res, req)
+		actual := <-requests
+		if !reflect.DeepEqual(tc.expected, actual) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, tc.proxy, tc.expected, actual)
+			t.Fail()
+		}
+		if http.StatusOK != res.Code {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %s\n\n\texp: %#v\n\n\tgot: %#v\n\n", filepath.Base(file), line, tc.proxy, http.StatusOK, res.Code)
+			t.Fail()
+		}
+	}
+}
+
+func TestSocks4Server(t *testing.T) {
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("socks4 rejects", func(t *testing.T) {
+		proxyAddr, _ := fakeSocks4(0x5b)
+		e.GET("/127.0.0.1:80").
+			WithQuery("proxy", "socks4://"+proxyAddr).
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status": "PROXY_CONNECT_ERROR",
+				"error":  "socks4: request rejected or failed",
+			})
+	})
+
+	t.Run("socks4a rejects", func(t *testing.T) {
+		proxyAddr, _ := fakeSocks4(0x5b)
+		e.GET("/example.com:80").
+			WithQuery("proxy", "socks4a://"+proxyAddr).
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "PROXY_CONNECT_ERROR")
+	})
+
+	t.Run("socks4 unreachable", func(t *testing.T) {
+		e.GET("/127.0.0.1:80").
+			WithQuery("proxy", "socks4://127.0.0.1:1").
+			Expect().
+			StatusRange(httpexpect.Status4xx).
+			JSON().Object().
+			ValueEqual("status", "PROXY_UNREACHABLE")
+	})
+}
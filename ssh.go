@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxSSHPreamble bounds the lines a server may send before its identification
+// string, which RFC 4253 allows, and maxSSHLine the length of each.
+const (
+	maxSSHPreamble = 16
+	maxSSHLine     = 255
+)
+
+// checkSSH connects to host:port and reads the server's SSH identification
+// string, such as SSH-2.0-OpenSSH_9.6, failing with SSH_BANNER_FAIL unless
+// one arrives within the timeout. No key exchange is attempted.
+func checkSSH(ctx context.Context, checker plainTest, host, port string) (int, result) {
+	c, latency, err := checker.Connect(ctx, host, port)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	defer c.Close()
+	if checker.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+	}
+	res := result{LatencyMS: millis(latency)}
+
+	_, s := startSpan(ctx, "ssh banner", trace.SpanKindClient)
+	defer s.End()
+	banner, err := readSSHBanner(bufio.NewReaderSize(c, maxSSHLine+2))
+	if err != nil {
+		setSpanStatus(s, false, err.Error())
+		res.Status, res.Error, res.Code = "SSH_BANNER_FAIL", err.Error(), errorCode(err)
+		return http.StatusBadGateway, res
+	}
+	setSpanStatus(s, true, "")
+	res.Status, res.Banner = "OK", banner
+	return http.StatusOK, res
+}
+
+// readSSHBanner returns the first line read from br that starts with SSH-,
+// skipping the preamble lines a server may send first.
+func readSSHBanner(br *bufio.Reader) (string, error) {
+	for i := 0; i <= maxSSHPreamble; i++ {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return "", fmt.Errorf("line longer than %d bytes; not an SSH server", maxSSHLine)
+		}
+		if err != nil {
+			return "", err
+		}
+		if id := strings.TrimRight(string(line), "\r\n"); strings.HasPrefix(id, "SSH-") {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("no identification string in the first %d lines; not an SSH server", maxSSHPreamble+1)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestSSHMode(t *testing.T) {
+	serve := func(greeting string) (string, func()) {
+		l, _ := net.Listen("tcp", "127.0.0.1:")
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				io.WriteString(c, greeting)
+				go func() {
+					io.Copy(io.Discard, c)
+					c.Close()
+				}()
+			}
+		}()
+		return l.Addr().String(), func() { l.Close() }
+	}
+	sshd, stop := serve("SSH-2.0-OpenSSH_9.6\r\n")
+	defer stop()
+	web, stop := serve("HTTP/1.1 400 Bad Request\r\n\r\n")
+	defer stop()
+	silent, stop := serve("")
+	defer stop()
+
+	svr := httptest.NewServer(Run(200 * time.Millisecond))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	e.GET("/"+sshd).
+		WithQuery("mode", "ssh").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status": "OK",
+			"banner": "SSH-2.0-OpenSSH_9.6",
+		})
+	e.GET("/"+web).
+		WithQuery("mode", "ssh").
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		ValueEqual("status", "SSH_BANNER_FAIL")
+	e.GET("/"+silent).
+		WithQuery("mode", "ssh").
+		Expect().
+		Status(http.StatusBadGateway).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"status": "SSH_BANNER_FAIL",
+			"code":   "ERR_TIMEOUT",
+		})
+}
+
+func TestReadSSHBanner(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		exp    string
+		hasErr bool
+	}{
+		{"SSH-2.0-OpenSSH_9.6\r\n", "SSH-2.0-OpenSSH_9.6", false},
+		{"Welcome to the bastion\r\nSSH-2.0-dropbear\n", "SSH-2.0-dropbear", false},
+		{strings.Repeat("x", 300) + "\n", "", true},
+		{strings.Repeat("hello\n", 20), "", true},
+		{"SSH-2.0-cut", "", true},
+	} {
+		got, err := readSSHBanner(bufio.NewReaderSize(strings.NewReader(c.in), maxSSHLine+2))
+		if !reflect.DeepEqual(c.exp, got) || (err != nil) != c.hasErr {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %q\n\n\texp: %#v\n\n\tgot: %#v (%v)\n\n", file, line, c.in, c.exp, got, err)
+			t.Fail()
+		}
+	}
+}
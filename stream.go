@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// streamHandler serves /stream, checking a list of targets like /batch but
+// sending each result as a server-sent event as soon as its check finishes.
+// Targets come from a POST body in the /batch format, or from repeated
+// ?target=host:port parameters on a GET, sharing the other query options.
+// Every event carries the index of its target as the event id, and a final
+// done event follows the last result.
+func streamHandler(timeout time.Duration, cfg config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, result{
+				Status: "METHOD_NOT_ALLOWED",
+				Error:  r.Method + " not allowed; use GET or POST",
+			})
+			return
+		}
+		timeout, err := requestTimeout(r, timeout, cfg.maxTimeout)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, result{
+				Status: "INVALID_TIMEOUT",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+			})
+			return
+		}
+		targets, err := streamTargets(w, r, cfg)
+		if err != nil {
+			writeBatchError(w, err)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSON(w, http.StatusInternalServerError, result{
+				Status: "STREAMING_UNSUPPORTED",
+				Error:  "the response cannot be streamed",
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		id := w.Header().Get(requestIDHeader)
+		streamBatch(r.Context(), cfg, targets, timeout, func(i int, res result) {
+			res.RequestID = id
+			data, _ := json.Marshal(res)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", i, data)
+			flusher.Flush()
+		})
+		fmt.Fprintf(w, "event: done\ndata: {\"count\":%d}\n\n", len(targets))
+		flusher.Flush()
+	})
+}
+
+// streamTargets reads the targets of a /stream request, no more than
+// cfg.maxBatchTargets of them.
+func streamTargets(w http.ResponseWriter, r *http.Request, cfg config) ([]target, error) {
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.maxBatchTargets)*maxTargetBytes)
+		targets, err := jsonTargets(r.Body, cfg.maxBatchTargets)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 0 {
+			return nil, errors.New("no targets")
+		}
+		return targets, nil
+	}
+	addrs := r.URL.Query()["target"]
+	if len(addrs) == 0 {
+		return nil, errors.New("no targets; pass one or more ?target=host:port")
+	}
+	if len(addrs) > cfg.maxBatchTargets {
+		return nil, &tooManyTargetsError{cfg.maxBatchTargets}
+	}
+	targets := make([]target, len(addrs))
+	for i, addr := range addrs {
+		host, port, err := parseTarget(addr)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %v", addr, err)
+		}
+		targets[i] = queryTarget(r)
+		targets[i].Host, targets[i].Port = host, port
+	}
+	return targets, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// readEvents collects the events of a server-sent event stream, keyed by
+// event id, and reports whether the done event was seen.
+func readEvents(t *testing.T, res *http.Response) (map[string]result, bool) {
+	defer res.Body.Close()
+	events := map[string]result{}
+	var id, event string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "":
+			var res result
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &res); err != nil {
+				t.Error(err)
+			}
+			events[id] = res
+		}
+	}
+	return events, event == "done"
+}
+
+func TestStream(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	svr := httptest.NewServer(Run(time.Second))
+	defer svr.Close()
+
+	t.Run("targets from query", func(t *testing.T) {
+		q := url.Values{"target": {l.Addr().String(), "127.0.0.1:1"}}
+		res, err := http.Get(svr.URL + "/stream?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		events, done := readEvents(t, res)
+		if !done {
+			t.Error("expected a done event")
+		}
+		if len(events) != 2 || events["0"].Status != "OK" || events["1"].Status != "HOST_REFUSED" {
+			t.Errorf("unexpected events %+v", events)
+		}
+		if events["0"].Target != l.Addr().String() || events["1"].Target != "127.0.0.1:1" {
+			t.Errorf("events do not name their targets: %+v", events)
+		}
+	})
+
+	t.Run("targets from body", func(t *testing.T) {
+		res, err := http.Post(svr.URL+"/stream", "application/json",
+			strings.NewReader(`{"targets":[{"host":"127.0.0.1","port":"1"}]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, done := readEvents(t, res)
+		if !done || len(events) != 1 || events["0"].Status != "HOST_REFUSED" {
+			t.Errorf("unexpected events %+v", events)
+		}
+	})
+
+	e := httpexpect.New(t, svr.URL)
+	t.Run("no targets", func(t *testing.T) {
+		e.GET("/stream").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_BATCH")
+	})
+
+	t.Run("bad target", func(t *testing.T) {
+		e.GET("/stream").
+			WithQuery("target", "nope").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_BATCH")
+	})
+}
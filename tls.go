@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// clientAuthProbe bounds how long checkTLS waits, after a TLS 1.3 handshake in
+// which the server asked for a client certificate, for the server to reject
+// the certificate sent.
+const clientAuthProbe = 200 * time.Millisecond
+
+// checkTLS connects to host:port and completes a TLS handshake, verifying the
+// server's certificate chain for host against cfg.rootCAs, or the system pool
+// when unset. When the server asks for a client certificate, cfg.clientCert is
+// presented and the mtls field reports whether the server accepted it. The
+// protocols in alpn are offered, and the one the server picks is reported.
+func checkTLS(ctx context.Context, cfg config, checker plainTest, host, port string, alpn []string) (int, result) {
+	c, latency, err := checker.Connect(ctx, host, port)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	defer c.Close()
+	if checker.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+	}
+
+	// verification is done below so that a bad certificate can be told
+	// apart from a failed handshake
+	var requested bool
+	conn := tls.Client(c, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		NextProtos:         alpn,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			requested = true
+			if cfg.clientCert != nil {
+				return cfg.clientCert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	})
+	_, s := startSpan(ctx, "tls handshake", trace.SpanKindClient)
+	err = conn.HandshakeContext(ctx)
+	if err == nil && requested && conn.ConnectionState().Version >= tls.VersionTLS13 {
+		// a TLS 1.3 server verifies the client certificate after the client
+		// has finished its side of the handshake, so a rejection only shows
+		// up as an alert on the next read
+		_ = c.SetReadDeadline(time.Now().Add(clientAuthProbe))
+		if _, rerr := conn.Read(make([]byte, 1)); rerr != nil {
+			if ne, ok := rerr.(net.Error); !ok || !ne.Timeout() {
+				err = rerr
+			}
+		}
+		if checker.Timeout > 0 {
+			_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+		}
+	}
+	setSpanStatus(s, err == nil, fmt.Sprint(err))
+	s.End()
+	var mtls *bool
+	if requested {
+		ok := err == nil && cfg.clientCert != nil
+		mtls = &ok
+	}
+	if err != nil {
+		status := "TLS_HANDSHAKE_FAIL"
+		if requested && cfg.clientCert == nil {
+			status = "TLS_CLIENT_CERT_REQUIRED"
+		}
+		return http.StatusBadGateway, result{
+			Status:    status,
+			Error:     err.Error(),
+			Code:      errorCode(err),
+			LatencyMS: millis(latency),
+			MTLS:      mtls,
+		}
+	}
+	state := conn.ConnectionState()
+	res := result{
+		Status:      "OK",
+		LatencyMS:   millis(latency),
+		TLSVersion:  tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		MTLS:        mtls,
+
+		ALPNNegotiated: state.NegotiatedProtocol,
+	}
+
+	certs := state.PeerCertificates
+	remaining := time.Until(certs[0].NotAfter)
+	days := int(remaining / (24 * time.Hour))
+	res.CertNotAfter = certs[0].NotAfter.UTC().Format(time.RFC3339)
+	res.CertDaysRemaining = &days
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         cfg.rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		res.Status = "TLS_CERT_INVALID"
+		res.Error = err.Error()
+		res.Code = errorCode(err)
+		return http.StatusBadGateway, res
+	}
+	if remaining < cfg.certWarning {
+		res.Warning = "CERT_EXPIRING_SOON"
+	}
+	return http.StatusOK, res
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestTLSMode(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer plainServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	trusted := httptest.NewServer(Run(time.Second, WithRootCAs(roots)))
+	defer trusted.Close()
+	untrusted := httptest.NewServer(Run(time.Second))
+	defer untrusted.Close()
+
+	t.Run("valid certificate", func(t *testing.T) {
+		obj := httpexpect.New(t, trusted.URL).
+			GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ValueEqual("status", "OK")
+		obj.Value("tls_version").String().NotEmpty()
+		obj.Value("cipher_suite").String().NotEmpty()
+		obj.Value("cert_not_after").String().Equal(
+			tlsServer.Certificate().NotAfter.UTC().Format(time.RFC3339))
+		obj.Value("cert_days_remaining").Number().Gt(0)
+		obj.NotContainsKey("warning")
+	})
+
+	t.Run("certificate expiring soon", func(t *testing.T) {
+		svr := httptest.NewServer(Run(time.Second,
+			WithRootCAs(roots),
+			WithCertWarning(time.Until(tlsServer.Certificate().NotAfter)+time.Hour),
+		))
+		defer svr.Close()
+		httpexpect.New(t, svr.URL).
+			GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("warning", "CERT_EXPIRING_SOON")
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		httpexpect.New(t, untrusted.URL).
+			GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "TLS_CERT_INVALID").
+			ContainsKey("error")
+	})
+
+	t.Run("handshake fails", func(t *testing.T) {
+		httpexpect.New(t, trusted.URL).
+			GET("/"+plainServer.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "TLS_HANDSHAKE_FAIL")
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		httpexpect.New(t, trusted.URL).
+			GET("/"+plainServer.Listener.Addr().String()).
+			WithQuery("mode", "carrier-pigeon").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_MODE")
+	})
+}
+
+// newClientCert returns a self-signed client certificate.
+func newClientCert(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	trustedCert := newClientCert(t, "trusted")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(trustedCert.Leaf)
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.TLS = &tls.Config{
+				ClientAuth: tls.RequireAndVerifyClientCert,
+				ClientCAs:  clientCAs,
+				MaxVersion: version,
+			}
+			server.StartTLS()
+			defer server.Close()
+			roots := x509.NewCertPool()
+			roots.AddCert(server.Certificate())
+
+			for _, c := range []struct {
+				name   string
+				opts   []Option
+				code   int
+				status string
+				mtls   bool
+			}{
+				{"trusted certificate", []Option{WithClientCertificate(trustedCert)}, http.StatusOK, "OK", true},
+				{"untrusted certificate", []Option{WithClientCertificate(newClientCert(t, "stranger"))}, http.StatusBadGateway, "TLS_HANDSHAKE_FAIL", false},
+				{"no certificate", nil, http.StatusBadGateway, "TLS_CLIENT_CERT_REQUIRED", false},
+			} {
+				t.Run(c.name, func(t *testing.T) {
+					svr := httptest.NewServer(Run(time.Second, append(c.opts, WithRootCAs(roots))...))
+					defer svr.Close()
+
+					httpexpect.New(t, svr.URL).
+						GET("/"+server.Listener.Addr().String()).
+						WithQuery("mode", "tls").
+						Expect().
+						Status(c.code).
+						JSON().Object().
+						ContainsMap(map[string]interface{}{
+							"status": c.status,
+							"mtls":   c.mtls,
+						})
+				})
+			}
+		})
+	}
+
+	t.Run("not requested", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots), WithClientCertificate(trustedCert)))
+		defer svr.Close()
+
+		httpexpect.New(t, svr.URL).
+			GET("/"+server.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			NotContainsKey("mtls")
+	})
+}
+
+func TestTLSALPN(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(h2.Certificate())
+	svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	for alpn, negotiated := range map[string]string{
+		"h2,http/1.1": "h2",
+		"http/1.1,h2": "h2",
+		"spdy/3,h2":   "h2",
+	} {
+		e.GET("/"+h2.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			WithQuery("alpn", alpn).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("alpn_negotiated", negotiated)
+	}
+	// the server offers only h2, and lets a client wanting http/1.1 go on
+	// without agreeing on a protocol
+	for _, alpn := range []string{"", "http/1.1"} {
+		e.GET("/"+h2.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			WithQuery("alpn", alpn).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			NotContainsKey("alpn_negotiated")
+	}
+
+	for _, q := range []map[string]string{
+		{"alpn": "h2"},
+		{"mode": "http", "alpn": "h2"},
+		{"mode": "tls", "alpn": "h2,,http/1.1"},
+	} {
+		req := e.GET("/" + h2.Listener.Addr().String())
+		for k, v := range q {
+			req = req.WithQuery(k, v)
+		}
+		req.Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_ALPN")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the instrumentation scope spans are recorded under.
+const tracerName = "github.com/joshq00/willitgo"
+
+// tracePropagator carries the trace of an incoming request, and of each check
+// into the requests it makes, as a W3C traceparent header.
+var tracePropagator = propagation.TraceContext{}
+
+// newTracerProvider configures tracing from the standard OTEL_ environment
+// variables. The exporter is the one autoexport picks from
+// OTEL_TRACES_EXPORTER and OTEL_EXPORTER_OTLP_PROTOCOL, and the SDK reads the
+// sampler and batching limits from OTEL_TRACES_SAMPLER and OTEL_BSP_*. It
+// returns nil, leaving tracing off, unless an OTLP endpoint is set or
+// OTEL_TRACES_EXPORTER names an exporter other than none.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+	exporter, err := autoexport.NewSpanExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if autoexport.IsNoneSpanExporter(exporter) {
+		return nil, nil
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES, read last, override
+	// the default service name
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", "willitgo")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// startSpan starts a span for an operation within the span carried by ctx,
+// recorded by the same tracer provider. When ctx carries no span, as when
+// tracing is off, the span returned records nothing.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).
+		Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// setSpanStatus marks s as succeeded, or as failed with msg when ok is false.
+func setSpanStatus(s trace.Span, ok bool, msg string) {
+	if ok {
+		s.SetStatus(codes.Ok, "")
+		return
+	}
+	s.SetStatus(codes.Error, msg)
+}
+
+// traceRequests wraps h in a server span named name, continuing the trace of
+// an incoming traceparent header. The span is passed down in the request
+// context and records the target and the status of the result written. A nil
+// tp leaves h untraced.
+func traceRequests(tp trace.TracerProvider, name string, h http.Handler) http.Handler {
+	if tp == nil {
+		return h
+	}
+	tracer := tp.Tracer(tracerName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, s := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+		defer s.End()
+
+		rec := &resultRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+
+		if host, port, err := parseTarget(r.URL.Path[1:]); err == nil {
+			s.SetAttributes(attribute.String("host", host), attribute.String("port", port))
+		}
+		if proxy := r.URL.Query().Get("proxy"); proxy != "" {
+			s.SetAttributes(attribute.String("proxy", proxy))
+		}
+		s.SetAttributes(attribute.Int("http.status_code", rec.code))
+		if rec.status != "" {
+			s.SetAttributes(attribute.String("status", rec.status))
+		}
+		setSpanStatus(s, rec.code < 400, rec.err)
+	})
+}
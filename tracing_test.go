@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanAttr returns the value of the attribute key recorded on s, or nil.
+func spanAttr(s tracetest.SpanStub, key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == attribute.Key(key) {
+			return a.Value.AsInterface()
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+	svr := httptest.NewServer(Run(time.Second, WithTracerProvider(tp)))
+	defer svr.Close()
+
+	httpexpect.New(t, svr.URL).
+		GET("/"+l.Addr().String()).
+		WithHeader("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01").
+		Expect().
+		Status(http.StatusOK)
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		byName[s.Name] = s
+	}
+	check, dial := byName["check"], byName["dial"]
+
+	for _, c := range []struct{ exp, got interface{} }{
+		{"4bf92f3577b34da6a3ce929d0e0e4736", check.SpanContext.TraceID().String()},
+		{"00f067aa0ba902b7", check.Parent.SpanID().String()},
+		{host, spanAttr(check, "host")},
+		{port, spanAttr(check, "port")},
+		{"OK", spanAttr(check, "status")},
+		{check.SpanContext.TraceID(), dial.SpanContext.TraceID()},
+		{check.SpanContext.SpanID(), dial.Parent.SpanID()},
+		{l.Addr().String(), spanAttr(dial, "address")},
+	} {
+		if !reflect.DeepEqual(c.exp, c.got) {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\n\n", file, line, c.exp, c.got)
+			t.Fail()
+		}
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	_, s := startSpan(context.Background(), "dial", trace.SpanKindClient)
+	if s.IsRecording() || s.SpanContext().IsValid() {
+		t.Error("expected a span that records nothing without a span in the context")
+	}
+	s.End()
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	for _, c := range []struct {
+		env     map[string]string
+		enabled bool
+		err     bool
+	}{
+		{env: map[string]string{}},
+		{env: map[string]string{"OTEL_TRACES_EXPORTER": "none"}},
+		{env: map[string]string{"OTEL_TRACES_EXPORTER": "console"}, enabled: true},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://127.0.0.1:4318"}, enabled: true},
+		{env: map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://127.0.0.1:4317",
+			"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+		}, enabled: true},
+		{env: map[string]string{"OTEL_TRACES_EXPORTER": "zipkin-ish"}, err: true},
+	} {
+		for _, k := range []string{"OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+			t.Setenv(k, c.env[k])
+		}
+		tp, err := newTracerProvider(context.Background())
+		if (err != nil) != c.err || (tp != nil) != c.enabled {
+			_, file, line, _ := runtime.Caller(0)
+			t.Logf("%s:%d: %v:\n\n\texp: enabled %v, error %v\n\n\tgot: %v, %v\n\n", file, line, c.env, c.enabled, c.err, tp, err)
+			t.Fail()
+		}
+		if tp != nil {
+			tp.Shutdown(context.Background())
+		}
+	}
+}
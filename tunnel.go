@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// through checks host:port with checker over a tunnel opened through proxy,
+// so that the mode's handshake or request reaches the target by way of the
+// proxy. When the tunnel cannot be opened the result is the proxy's, as check
+// would report it; otherwise it is the mode's, along with how the tunnel was
+// set up. Proxy fallback chains and HTTP/2 tunnels are not supported.
+func (p proxyHandler) through(ctx context.Context, checker Checker, proxy, host, port string, opts Options) (int, result) {
+	// the http modes' transport may still be dialing after a timed out
+	// request returns, so what the tunnel records is guarded by mu
+	var mu sync.Mutex
+	var tunnel result
+	var tunnelErr error
+	opts.Dialer.Tunnel = func(ctx context.Context, host, port string) (net.Conn, time.Duration, error) {
+		c, res, err := p.open(ctx, proxy, host, port, true)
+		mu.Lock()
+		defer mu.Unlock()
+		tunnel, tunnelErr = res, err
+		return c, time.Duration(res.LatencyMS * float64(time.Millisecond)), err
+	}
+	code, res := checker.Check(ctx, host, port, opts)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err, ok := tunnelErr.(*proxyError); ok {
+		tunnel.err = err.Err
+		return err.Code, tunnel
+	}
+	res.Proxy = proxy
+	res.ConnectMS = tunnel.ConnectMS
+	res.ProxyReused = tunnel.ProxyReused
+	res.ProxyHeaders = tunnel.ProxyHeaders
+	return code, res
+}
+
+// held returns the tunnel c to a caller that asked to hold it, and nil to one
+// that did not. Whatever br read past the proxy's answer came from the target
+// and is read before the rest of the tunnel.
+func held(c net.Conn, br *bufio.Reader, hold bool) net.Conn {
+	if !hold {
+		return nil
+	}
+	if br != nil && br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}
+	}
+	return c
+}
+
+// bufferedConn is a net.Conn read through a bufio.Reader that already holds
+// some of its bytes.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
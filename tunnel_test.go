@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// fakeTunnelProxy carries CONNECT tunnels to their targets, answering with
+// status and a Via header. A refused tunnel is closed once answered.
+func fakeTunnelProxy(t *testing.T, status int) (string, func()) {
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nVia: 1.1 fake\r\n\r\n", status, http.StatusText(status))
+				if status != http.StatusOK {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, br)
+				io.Copy(c, target)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestModeThroughProxy(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer tlsServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	proxy, stop := fakeTunnelProxy(t, http.StatusOK)
+	defer stop()
+	refusing, stopRefusing := fakeTunnelProxy(t, http.StatusForbidden)
+	defer stopRefusing()
+
+	t.Run("tls", func(t *testing.T) {
+		obj := e.GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			WithQuery("proxy", proxy).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		obj.ValueEqual("status", "OK").
+			ValueEqual("proxy", proxy).
+			ValueEqual("proxy_headers", map[string]string{"Via": "1.1 fake"})
+		obj.Value("tls_version").String().NotEmpty()
+		obj.Value("cert_days_remaining").Number().Gt(0)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		e.GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "https").
+			WithQuery("proxy", proxy).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("http_status", http.StatusOK).
+			ValueEqual("proxy", proxy)
+	})
+
+	t.Run("refused tunnel", func(t *testing.T) {
+		e.GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "tls").
+			WithQuery("proxy", refusing).
+			Expect().
+			Status(http.StatusForbidden).
+			JSON().Object().
+			ValueEqual("status", "PROXY_REFUSED").
+			ValueEqual("proxy_status_text", "Forbidden").
+			NotContainsKey("tls_version")
+	})
+
+	t.Run("target bytes sent with the proxy's answer", func(t *testing.T) {
+		// a proxy answering in the same write as the target's banner
+		l, _ := net.Listen("tcp", "127.0.0.1:")
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			http.ReadRequest(bufio.NewReader(c))
+			io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-fake\r\n")
+			time.Sleep(time.Second)
+		}()
+		e.GET("/example.com:22").
+			WithQuery("mode", "ssh").
+			WithQuery("proxy", l.Addr().String()).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("banner", "SSH-2.0-fake")
+	})
+
+	for _, c := range []struct {
+		name  string
+		query map[string]string
+	}{
+		{"mode without a tunnel", map[string]string{"mode": "dns", "proxy": proxy}},
+		{"http2 tunnel", map[string]string{"mode": "tls", "proxy": proxy, "proxy-http2": "true"}},
+		{"fallback chain", map[string]string{"mode": "tls", "proxy": proxy + "," + refusing}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := e.GET("/" + tlsServer.Listener.Addr().String())
+			for k, v := range c.query {
+				req = req.WithQuery(k, v)
+			}
+			req.Expect().
+				Status(http.StatusBadRequest).
+				JSON().Object().
+				ValueEqual("status", "INVALID_MODE")
+		})
+	}
+}
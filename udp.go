@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// checkUDP sets up a UDP socket to host:port. UDP is connectionless, so on
+// its own this only shows that the address resolved and a route exists. With
+// probe set, a single zero byte is sent and the check waits for a reply; an
+// ICMP port unreachable fails the check while silence is reported as
+// inconclusive.
+func checkUDP(ctx context.Context, checker plainTest, host, port string, probe bool) (int, result) {
+	c, latency, err := checker.Connect(ctx, host, port)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	defer c.Close()
+	res := result{
+		Status:    "OK",
+		LatencyMS: millis(latency),
+		Note:      "udp socket established; udp is connectionless so this does not confirm the port is open",
+	}
+	if !probe {
+		return http.StatusOK, res
+	}
+
+	if checker.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+	}
+	if _, err := c.Write([]byte{0}); err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return http.StatusBadGateway, result{
+				Status: "HOST_CONNECT_FAIL",
+				Error:  err.Error(),
+				Code:   errorCode(err),
+				Note:   "probe rejected with icmp port unreachable",
+				err:    err,
+			}
+		}
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			res.Note = "no reply to probe before the timeout; the port may be open or filtered"
+			return http.StatusOK, res
+		}
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	res.Note = "received a reply to the udp probe"
+	return http.StatusOK, res
+}
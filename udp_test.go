@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestUDP(t *testing.T) {
+	echo, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	silent, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer silent.Close()
+	closed, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	svr := httptest.NewServer(Run(100 * time.Millisecond))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("socket only", func(t *testing.T) {
+		e.GET("/"+closedAddr).
+			WithQuery("proto", "udp").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ContainsKey("note")
+	})
+
+	t.Run("probe answered", func(t *testing.T) {
+		e.GET("/"+echo.LocalAddr().String()).
+			WithQuery("proto", "udp").
+			WithQuery("probe", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("note", "received a reply to the udp probe")
+	})
+
+	t.Run("probe unanswered", func(t *testing.T) {
+		e.GET("/"+silent.LocalAddr().String()).
+			WithQuery("proto", "udp").
+			WithQuery("probe", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ValueEqual("note", "no reply to probe before the timeout; the port may be open or filtered")
+	})
+
+	t.Run("probe refused", func(t *testing.T) {
+		e.GET("/"+closedAddr).
+			WithQuery("proto", "udp").
+			WithQuery("probe", "true").
+			WithQuery("raw-error", "true").
+			Expect().
+			StatusRange(httpexpect.Status5xx).
+			JSON().Object().
+			ValueEqual("status", "HOST_CONNECT_FAIL").
+			ValueEqual("errno", int(syscall.ECONNREFUSED)).
+			ContainsKey("code")
+	})
+
+	t.Run("not through a proxy", func(t *testing.T) {
+		e.GET("/"+echo.LocalAddr().String()).
+			WithQuery("proto", "udp").
+			WithQuery("proxy", "127.0.0.1:1").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("status", "INVALID_PROTO")
+	})
+}
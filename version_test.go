@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+func TestVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "abc123", "2024-01-02T03:04:05Z"
+
+	svr := httptest.NewServer(Run(time.Second, WithToken("s3cret")))
+	defer svr.Close()
+
+	httpexpect.New(t, svr.URL).
+		GET("/version").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ContainsMap(map[string]interface{}{
+			"version":    "1.2.0",
+			"commit":     "abc123",
+			"build_date": "2024-01-02T03:04:05Z",
+			"go_version": runtime.Version(),
+		})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// wsGUID is appended to a Sec-WebSocket-Key to derive the Sec-WebSocket-Accept
+// a server must answer with, per RFC 6455.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+)
+
+// maxWSFrames bounds how many frames checkWS reads while waiting for a pong.
+const maxWSFrames = 16
+
+// checkWS connects to host:port, over TLS when secure is set, and asks to
+// upgrade path to a WebSocket. The check fails with WS_UPGRADE_FAIL unless the
+// server switches protocols with the Sec-WebSocket-Accept matching the key
+// sent. With ping set a ping is sent as well, failing with WS_PING_FAIL when
+// no pong comes back within the timeout.
+func checkWS(ctx context.Context, cfg config, checker plainTest, host, port, path string, secure, ping bool) (int, result) {
+	if path == "" {
+		path = "/"
+	}
+	c, latency, err := checker.Connect(ctx, host, port)
+	if err != nil {
+		return http.StatusBadGateway, result{
+			Status: "HOST_CONNECT_FAIL",
+			Error:  err.Error(),
+			Code:   errorCode(err),
+			err:    err,
+		}
+	}
+	defer c.Close()
+	if checker.Timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(checker.Timeout))
+	}
+	res := result{LatencyMS: millis(latency)}
+
+	scheme := "ws"
+	if secure {
+		scheme = "wss"
+		conn := tls.Client(c, &tls.Config{
+			ServerName: host,
+			RootCAs:    cfg.rootCAs,
+		})
+		_, s := startSpan(ctx, "tls handshake", trace.SpanKindClient)
+		err := conn.HandshakeContext(ctx)
+		setSpanStatus(s, err == nil, fmt.Sprint(err))
+		s.End()
+		if err != nil {
+			res.Status, res.Error = "TLS_HANDSHAKE_FAIL", err.Error()
+			res.Code = errorCode(err)
+			var certErr *tls.CertificateVerificationError
+			if errors.As(err, &certErr) {
+				res.Status = "TLS_CERT_INVALID"
+			}
+			return http.StatusBadGateway, res
+		}
+		state := conn.ConnectionState()
+		res.TLSVersion = tls.VersionName(state.Version)
+		res.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		c = conn
+	}
+
+	u := url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port), Path: path}
+	sctx, s := startSpan(ctx, "websocket upgrade", trace.SpanKindClient)
+	s.SetAttributes(attribute.String("url", u.String()))
+	defer s.End()
+	fail := func(status string, err error) (int, result) {
+		setSpanStatus(s, false, err.Error())
+		res.Status, res.Error = status, err.Error()
+		res.Code = errorCode(err)
+		return http.StatusBadGateway, res
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fail("WS_UPGRADE_FAIL", err)
+	}
+	req.Header = cfg.requestHeader()
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	tracePropagator.Inject(sctx, propagation.HeaderCarrier(req.Header))
+	if err := req.Write(c); err != nil {
+		return fail("WS_UPGRADE_FAIL", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return fail("WS_UPGRADE_FAIL", err)
+	}
+	res.HTTPStatus = resp.StatusCode
+	s.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return fail("WS_UPGRADE_FAIL", fmt.Errorf("server answered %s", resp.Status))
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != wsAccept(key) {
+		return fail("WS_UPGRADE_FAIL", fmt.Errorf("Sec-WebSocket-Accept %q does not match the key sent", accept))
+	}
+
+	if ping {
+		if err := wsPing(c, br); err != nil {
+			return fail("WS_PING_FAIL", err)
+		}
+	}
+	// say goodbye properly, with a normal closure
+	wsWriteFrame(c, wsOpClose, []byte{0x03, 0xe8})
+	setSpanStatus(s, true, "")
+	res.Status = "OK"
+	return http.StatusOK, res
+}
+
+// wsAccept returns the Sec-WebSocket-Accept a server must answer key with.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsPing sends a ping over c and waits for the pong, skipping any data frames
+// the server sends first.
+func wsPing(c net.Conn, br *bufio.Reader) error {
+	payload := []byte("willitgo")
+	if err := wsWriteFrame(c, wsOpPing, payload); err != nil {
+		return err
+	}
+	for i := 0; i < maxWSFrames; i++ {
+		op, data, err := wsReadFrame(br)
+		if err != nil {
+			return fmt.Errorf("waiting for pong: %v", err)
+		}
+		switch op {
+		case wsOpPong:
+			if string(data) == string(payload) {
+				return nil
+			}
+		case wsOpClose:
+			return errors.New("server closed the connection instead of answering the ping")
+		}
+	}
+	return fmt.Errorf("no pong among the first %d frames", maxWSFrames)
+}
+
+// wsWriteFrame writes a final, masked client frame carrying payload, which
+// must be under 126 bytes.
+func wsWriteFrame(w io.Writer, op byte, payload []byte) error {
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	rand.Read(frame[2:6])
+	for i, b := range payload {
+		frame = append(frame, b^frame[2+i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// wsReadFrame reads one unmasked server frame, returning its opcode and
+// payload. Payloads of data frames are discarded rather than returned.
+func wsReadFrame(br *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op := head[0] & 0x0f
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(ext[0])<<8 | uint64(ext[1])
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, b := range ext {
+			n = n<<8 | uint64(b)
+		}
+	}
+	if head[1]&0x80 != 0 {
+		return 0, nil, errors.New("server sent a masked frame")
+	}
+	if op < wsOpClose {
+		_, err := io.CopyN(io.Discard, br, int64(n))
+		return op, nil, err
+	}
+	if n > 125 {
+		return 0, nil, fmt.Errorf("control frame of %d bytes", n)
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(br, data)
+	return op, data, err
+}
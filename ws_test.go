@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect"
+)
+
+// wsEcho upgrades requests to /ws and answers pings with pongs until the
+// client sends a close frame. With badAccept the handshake is answered with
+// the wrong Sec-WebSocket-Accept.
+func wsEcho(t *testing.T, badAccept bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" || r.Header.Get("Upgrade") != "websocket" {
+			fmt.Fprintln(w, "not a websocket")
+			return
+		}
+		accept := wsAccept(r.Header.Get("Sec-WebSocket-Key"))
+		if badAccept {
+			accept = wsAccept("nope")
+		}
+		c, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+		// a text frame first, which the client should skip
+		rw.Write([]byte{0x81, 2, 'h', 'i'})
+		rw.Flush()
+		for {
+			op, payload, err := readClientFrame(rw.Reader)
+			if err != nil || op == wsOpClose {
+				return
+			}
+			if op == wsOpPing {
+				rw.Write(append([]byte{0x80 | wsOpPong, byte(len(payload))}, payload...))
+				rw.Flush()
+			}
+		}
+	})
+}
+
+func readClientFrame(br *bufio.Reader) (byte, []byte, error) {
+	var head [6]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= head[2+i%4]
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+func TestWebSocketMode(t *testing.T) {
+	ts := httptest.NewServer(wsEcho(t, false))
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(wsEcho(t, false))
+	defer tlsServer.Close()
+	bad := httptest.NewServer(wsEcho(t, true))
+	defer bad.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	svr := httptest.NewServer(Run(time.Second, WithRootCAs(roots)))
+	defer svr.Close()
+	e := httpexpect.New(t, svr.URL)
+
+	t.Run("upgrade", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "ws").
+			WithQuery("path", "/ws").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":      "OK",
+				"http_status": http.StatusSwitchingProtocols,
+			})
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "ws").
+			WithQuery("path", "/ws").
+			WithQuery("probe", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK")
+	})
+
+	t.Run("wss", func(t *testing.T) {
+		e.GET("/"+tlsServer.Listener.Addr().String()).
+			WithQuery("mode", "wss").
+			WithQuery("path", "/ws").
+			WithQuery("probe", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			ValueEqual("status", "OK").
+			ContainsKey("tls_version")
+	})
+
+	t.Run("not a websocket", func(t *testing.T) {
+		e.GET("/"+ts.Listener.Addr().String()).
+			WithQuery("mode", "ws").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ContainsMap(map[string]interface{}{
+				"status":      "WS_UPGRADE_FAIL",
+				"http_status": http.StatusOK,
+			})
+	})
+
+	t.Run("bad accept", func(t *testing.T) {
+		e.GET("/"+bad.Listener.Addr().String()).
+			WithQuery("mode", "ws").
+			WithQuery("path", "/ws").
+			Expect().
+			Status(http.StatusBadGateway).
+			JSON().Object().
+			ValueEqual("status", "WS_UPGRADE_FAIL")
+	})
+}
+
+func TestWSAccept(t *testing.T) {
+	// the example handshake of RFC 6455
+	if exp, got := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); exp != got {
+		t.Errorf("exp %q, got %q", exp, got)
+	}
+}